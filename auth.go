@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+// newSecret returns a random secret and its hash. Only the hash is stored.
+func newSecret() (secret, hash string) {
+	secret = random.Base64(32)
+	return secret, hashSecret(secret)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSecret reports whether secret matches hash in constant time.
+func checkSecret(hash, secret string) bool {
+	if hash == "" || secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(hashSecret(secret))) == 1
+}
+
+// requestSecret returns the secret sent with req, either as a bearer token or
+// as the password of HTTP basic auth credentials so that secrets can be
+// embedded in URLs.
+func requestSecret(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	_, password, _ := req.BasicAuth()
+	return password
+}
+
+// authorizeCluster checks that the client making req may access cluster.
+// Writes require the cluster secret, reads only require it if the cluster is
+// private. Clusters created before secrets were introduced have no secret and
+// can be accessed by anyone until one is set. If the client is not allowed, an
+// error response is written and false is returned.
+func authorizeCluster(w http.ResponseWriter, req *http.Request, cluster *discovery.Cluster, write bool) bool {
+	if msg := clusterAuthError(req, cluster, write); msg != "" {
+		unauthorized(w, msg)
+		return false
+	}
+	return true
+}
+
+// clusterAuthError returns why the client making req may not access cluster
+// according to the rules of authorizeCluster, or an empty string if it may.
+func clusterAuthError(req *http.Request, cluster *discovery.Cluster, write bool) string {
+	if cluster.SecretHash == "" || !write && !cluster.Private {
+		return ""
+	}
+	if checkSecret(cluster.SecretHash, requestSecret(req)) {
+		return ""
+	}
+	return "a valid cluster secret is required"
+}
+
+// authorizeInstance checks that the client making req is allowed to modify
+// inst, which requires the instance secret returned when it was registered.
+// Instances registered before instance secrets were introduced can be modified
+// with the cluster secret instead, or if the cluster has no secret either, by
+// the client that registered the instance or created the cluster as identified
+// by their source IP. If the client is not allowed, an error response is
+// written and false is returned.
+func authorizeInstance(w http.ResponseWriter, req *http.Request, cluster *discovery.Cluster, inst *discovery.Instance) bool {
+	if msg := instanceAuthError(req, cluster, inst); msg != "" {
+		unauthorized(w, msg)
+		return false
+	}
+	return true
+}
+
+// instanceAuthError returns why the client making req may not modify inst
+// according to the rules of authorizeInstance, or an empty string if it may.
+func instanceAuthError(req *http.Request, cluster *discovery.Cluster, inst *discovery.Instance) string {
+	if inst.SecretHash != "" {
+		if checkSecret(inst.SecretHash, requestSecret(req)) {
+			return ""
+		}
+		return "a valid instance secret is required"
+	}
+	if cluster.SecretHash != "" {
+		return clusterAuthError(req, cluster, true)
+	}
+	if ip := sourceIP(req); ip == inst.CreatorIP || ip == cluster.CreatorIP {
+		return ""
+	}
+	return "only the registering instance or the cluster creator may modify this instance"
+}
+
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="flynn-discovery"`)
+	httphelper.Error(w, httphelper.JSONError{
+		Code:    httphelper.UnauthorizedErrorCode,
+		Message: message,
+	})
+}
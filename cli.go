@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+func runClusterCreate(args []string) error {
+	flags := flag.NewFlagSet("cluster create", flag.ExitOnError)
+	size := flags.Int("size", 0, "expected number of instances")
+	private := flags.Bool("private", false, "require the cluster secret to list instances")
+	jsonOutput := flags.Bool("json", false, "print the cluster as JSON instead of its token URL")
+	flags.Usage = commandUsage(flags, "cluster create [options]")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	client, err := serverClient()
+	if err != nil {
+		return err
+	}
+	cluster := &discovery.Cluster{Size: *size, Private: *private}
+	if err := client.CreateCluster(cluster); err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(os.Stdout, cluster)
+	}
+	fmt.Println(tokenURL(client.URL, cluster.Secret, "clusters", cluster.ID))
+	return nil
+}
+
+func runInstanceRegister(args []string) error {
+	flags := flag.NewFlagSet("instance register", flag.ExitOnError)
+	name := flags.String("name", "", "instance name")
+	flynnVersion := flags.String("flynn-version", "", "Flynn version of the instance")
+	ttl := flags.Int("ttl", 0, "seconds the instance stays registered without a heartbeat")
+	jsonOutput := flags.Bool("json", false, "print the instance as JSON instead of its URL")
+	flags.Usage = commandUsage(flags, "instance register [options] CLUSTER URL")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	client, clusterID, err := clusterClient(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	inst := &discovery.Instance{
+		URL:          flags.Arg(1),
+		Name:         *name,
+		FlynnVersion: *flynnVersion,
+		TTL:          *ttl,
+	}
+	if err := client.RegisterInstance(clusterID, inst); err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(os.Stdout, inst)
+	}
+	// the URL includes the instance secret, which is needed to send
+	// heartbeats or remove the instance. It is empty if the instance was
+	// already registered.
+	fmt.Println(tokenURL(client.URL, inst.Secret, "clusters", inst.ClusterID, "instances", inst.ID))
+	return nil
+}
+
+func runInstanceList(args []string) error {
+	flags := flag.NewFlagSet("instance list", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "print the instances as JSON instead of a table")
+	flags.Usage = commandUsage(flags, "instance list [options] CLUSTER")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	client, clusterID, err := clusterClient(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	instances, err := client.Instances(clusterID)
+	if err != nil {
+		return err
+	}
+	return printInstances(os.Stdout, instances, *jsonOutput)
+}
+
+func runWait(args []string) error {
+	flags := flag.NewFlagSet("wait", flag.ExitOnError)
+	size := flags.Int("size", 0, "number of instances to wait for")
+	timeout := flags.Duration("timeout", 10*time.Minute, "maximum time to wait")
+	jsonOutput := flags.Bool("json", false, "print the instances as JSON instead of a table")
+	flags.Usage = commandUsage(flags, "wait -size N [options] CLUSTER")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *size <= 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	client, clusterID, err := clusterClient(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	instances, err := client.WaitForSize(clusterID, *size, *timeout)
+	if err != nil {
+		return err
+	}
+	return printInstances(os.Stdout, instances, *jsonOutput)
+}
+
+func runAdminShow(args []string) error {
+	flags := flag.NewFlagSet("admin show", flag.ExitOnError)
+	flags.Usage = commandUsage(flags, "admin show CLUSTER_ID")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	backend, err := openAdminBackend()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	cluster, err := backend.GetCluster(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", cluster.ID)
+	fmt.Fprintf(w, "Created At:\t%s\n", cluster.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Creator IP:\t%s\n", cluster.CreatorIP)
+	fmt.Fprintf(w, "Creator User Agent:\t%s\n", cluster.CreatorUserAgent)
+	fmt.Fprintf(w, "Has Secret:\t%t\n", cluster.SecretHash != "")
+	fmt.Fprintf(w, "Private:\t%t\n", cluster.Private)
+	fmt.Fprintf(w, "Size:\t%d\n", cluster.Size)
+	fmt.Fprintf(w, "Instances:\t%d\n", cluster.InstanceCount)
+	fmt.Fprintf(w, "Index:\t%d\n", cluster.Index)
+	fmt.Fprintf(w, "Last Active:\t%s\n", cluster.ActiveAt.Format(time.RFC3339))
+	return w.Flush()
+}
+
+func runAdminResetSecret(args []string) error {
+	flags := flag.NewFlagSet("admin reset-secret", flag.ExitOnError)
+	flags.Usage = commandUsage(flags, "admin reset-secret CLUSTER_ID")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	backend, err := openAdminBackend()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	cluster, err := backend.GetCluster(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	secret, hash := newSecret()
+	if err := backend.SetClusterSecret(cluster.ID, cluster.SecretHash, hash); err != nil {
+		return err
+	}
+	fmt.Println(secret)
+	return nil
+}
+
+func runAdminReap(args []string) error {
+	flags := flag.NewFlagSet("admin reap", flag.ExitOnError)
+	flags.Usage = commandUsage(flags, "admin reap")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	backend, err := openAdminBackend()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	expired, err := backend.DeleteExpiredInstances()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed %d expired instances\n", len(expired))
+	return nil
+}
+
+func runAdminGC(args []string) error {
+	flags := flag.NewFlagSet("admin gc", flag.ExitOnError)
+	var policy gcPolicy
+	flags.DurationVar(&policy.EmptyAfter, "empty-after", 0, "delete clusters without instances after this long (0 disables)")
+	flags.DurationVar(&policy.InactiveAfter, "inactive-after", 0, "delete clusters without activity for this long (0 disables)")
+	flags.IntVar(&policy.BatchSize, "batch-size", 100, "maximum number of clusters to delete at once")
+	flags.BoolVar(&policy.DryRun, "dry-run", false, "list abandoned clusters instead of deleting them")
+	flags.Usage = commandUsage(flags, "admin gc [options]")
+	flags.Parse(args)
+	if flags.NArg() != 0 || !policy.enabled() {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	backend, err := openAdminBackend()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tREASON\tCREATED\tLAST ACTIVE")
+	err = runGC(backend, policy, func(cluster *discovery.Cluster, reason string) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", cluster.ID, reason, cluster.CreatedAt.Format(time.RFC3339), cluster.ActiveAt.Format(time.RFC3339))
+	})
+	w.Flush()
+	return err
+}
+
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	status := flags.Bool("status", false, "show which migrations have been applied")
+	dryRun := flags.Bool("dry-run", false, "print the pending migrations instead of applying them")
+	flags.Usage = commandUsage(flags, "migrate [options]")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if *status {
+		return migrationStatus(db, os.Stdout)
+	}
+	return migrateDB(db, *dryRun, os.Stdout)
+}
+
+func commandUsage(flags *flag.FlagSet, usage string) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "usage: flynn-discovery %s\n\nOptions:\n", usage)
+		flags.PrintDefaults()
+	}
+}
+
+// serverClient returns a client for the server at $FLYNN_DISCOVERY_URL,
+// authenticated with $FLYNN_DISCOVERY_SECRET.
+func serverClient() (*discovery.Client, error) {
+	uri := os.Getenv("FLYNN_DISCOVERY_URL")
+	if uri == "" {
+		return nil, errors.New("FLYNN_DISCOVERY_URL is not set")
+	}
+	if !strings.Contains(uri, "://") {
+		uri = "http://" + uri
+	}
+	client, err := discovery.NewClient(uri)
+	if err != nil {
+		return nil, err
+	}
+	if secret := os.Getenv("FLYNN_DISCOVERY_SECRET"); secret != "" {
+		client.Secret = secret
+	}
+	return client, nil
+}
+
+// clusterClient returns a client and the cluster ID for a CLUSTER argument,
+// which is either a cluster token URL or a cluster ID on the server at
+// $FLYNN_DISCOVERY_URL.
+func clusterClient(cluster string) (*discovery.Client, string, error) {
+	if !strings.Contains(cluster, "://") {
+		client, err := serverClient()
+		return client, cluster, err
+	}
+	i := strings.LastIndex(cluster, "/clusters/")
+	if i < 0 {
+		return nil, "", fmt.Errorf("invalid cluster token URL %q", cluster)
+	}
+	client, err := discovery.NewClient(cluster[:i])
+	return client, strings.Trim(cluster[i+len("/clusters/"):], "/"), err
+}
+
+// tokenURL returns the URL of the object at path on the server at baseURL
+// with secret as the password, so that it can be passed around as a single
+// string.
+func tokenURL(baseURL, secret string, path ...string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return baseURL + "/" + strings.Join(path, "/")
+	}
+	if secret != "" {
+		u.User = url.UserPassword("", secret)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.Join(path, "/")
+	return u.String()
+}
+
+// printInstances writes instances to out as a table, or as a JSON array if
+// jsonOutput is true.
+func printInstances(out io.Writer, instances []*discovery.Instance, jsonOutput bool) error {
+	if jsonOutput {
+		if instances == nil {
+			instances = []*discovery.Instance{}
+		}
+		return printJSON(out, instances)
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tURL\tFLYNN VERSION\tCREATED")
+	for _, inst := range instances {
+		var created string
+		if inst.CreatedAt != nil {
+			created = inst.CreatedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", inst.ID, inst.Name, inst.URL, inst.FlynnVersion, created)
+	}
+	return w.Flush()
+}
+
+func printJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	return enc.Encode(v)
+}
+
+// openAdminBackend connects to the database at DATABASE_URL for admin
+// commands, which operate on the stored data directly.
+func openAdminBackend() (*PostgresBackend, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	return NewPostgresBackend(db).(*PostgresBackend), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+func TestClusterClient(t *testing.T) {
+	defer os.Setenv("FLYNN_DISCOVERY_URL", os.Getenv("FLYNN_DISCOVERY_URL"))
+	defer os.Setenv("FLYNN_DISCOVERY_SECRET", os.Getenv("FLYNN_DISCOVERY_SECRET"))
+	os.Setenv("FLYNN_DISCOVERY_URL", "discovery.example.com/")
+	os.Setenv("FLYNN_DISCOVERY_SECRET", "env-secret")
+
+	for _, test := range []struct {
+		cluster string
+		url     string
+		secret  string
+		id      string
+		err     bool
+	}{
+		// cluster IDs are on the server at $FLYNN_DISCOVERY_URL
+		{cluster: "c1", url: "http://discovery.example.com", secret: "env-secret", id: "c1"},
+		{cluster: "https://discovery.example.com/clusters/c1", url: "https://discovery.example.com", id: "c1"},
+		{cluster: "https://discovery.example.com/clusters/c1/", url: "https://discovery.example.com", id: "c1"},
+		{cluster: "https://:s3cret@discovery.example.com/clusters/c1", url: "https://discovery.example.com", secret: "s3cret", id: "c1"},
+		{cluster: "https://discovery.example.com/prefix/clusters/c1", url: "https://discovery.example.com/prefix", id: "c1"},
+		{cluster: "https://discovery.example.com/c1", err: true},
+	} {
+		client, id, err := clusterClient(test.cluster)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.cluster)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.cluster, err)
+			continue
+		}
+		if client.URL != test.url || client.Secret != test.secret || id != test.id {
+			t.Errorf("%s: expected %s with secret %q and cluster %s, got %s with secret %q and cluster %s", test.cluster, test.url, test.secret, test.id, client.URL, client.Secret, id)
+		}
+	}
+
+	os.Setenv("FLYNN_DISCOVERY_URL", "")
+	if _, _, err := clusterClient("c1"); err == nil {
+		t.Error("expected an error without FLYNN_DISCOVERY_URL")
+	}
+}
+
+func TestTokenURL(t *testing.T) {
+	for _, test := range []struct {
+		base     string
+		secret   string
+		path     []string
+		expected string
+	}{
+		{"https://discovery.example.com", "s3cret", []string{"clusters", "c1"}, "https://:s3cret@discovery.example.com/clusters/c1"},
+		{"https://discovery.example.com/", "s3cret", []string{"clusters", "c1"}, "https://:s3cret@discovery.example.com/clusters/c1"},
+		{"https://discovery.example.com/prefix", "", []string{"clusters", "c1"}, "https://discovery.example.com/prefix/clusters/c1"},
+		// secrets are base64, which needs escaping in URLs
+		{"https://discovery.example.com", "a/b+c=", []string{"clusters", "c1"}, "https://:a%2Fb+c=@discovery.example.com/clusters/c1"},
+	} {
+		if actual := tokenURL(test.base, test.secret, test.path...); actual != test.expected {
+			t.Errorf("tokenURL(%q, %q, %q): expected %q, got %q", test.base, test.secret, test.path, test.expected, actual)
+		}
+	}
+
+	// token URLs are accepted as cluster arguments
+	client, id, err := clusterClient(tokenURL("https://discovery.example.com", "a/b+c=", "clusters", "c1"))
+	if err != nil || client.Secret != "a/b+c=" || id != "c1" {
+		t.Errorf("expected secret a/b+c= and cluster c1, got %q and %q (%v)", client.Secret, id, err)
+	}
+}
+
+func TestPrintInstances(t *testing.T) {
+	created := time.Date(2015, 11, 4, 12, 0, 0, 0, time.UTC)
+	instances := []*discovery.Instance{
+		{ID: "i1", Name: "node1", URL: "http://10.0.0.1:1111", FlynnVersion: "v20151104.1", CreatedAt: &created},
+		{ID: "i2", URL: "http://10.0.0.2:1111"},
+	}
+
+	for _, test := range []struct {
+		name      string
+		instances []*discovery.Instance
+		expected  string
+	}{
+		{
+			name:      "table",
+			instances: instances,
+			expected: "ID  NAME   URL                   FLYNN VERSION  CREATED\n" +
+				"i1  node1  http://10.0.0.1:1111  v20151104.1    2015-11-04T12:00:00Z\n" +
+				"i2         http://10.0.0.2:1111                 \n",
+		},
+		{
+			name:     "empty table",
+			expected: "ID  NAME  URL  FLYNN VERSION  CREATED\n",
+		},
+	} {
+		var out bytes.Buffer
+		if err := printInstances(&out, test.instances, false); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, out.String())
+		}
+	}
+
+	for _, test := range []struct {
+		instances []*discovery.Instance
+		ids       []string
+	}{
+		{instances, []string{"i1", "i2"}},
+		// no instances are an empty array rather than null
+		{nil, []string{}},
+	} {
+		var out bytes.Buffer
+		if err := printInstances(&out, test.instances, true); err != nil {
+			t.Fatal(err)
+		}
+		var printed []*discovery.Instance
+		if err := json.Unmarshal(out.Bytes(), &printed); err != nil || printed == nil {
+			t.Fatalf("expected a JSON array, got %q (%v)", out.String(), err)
+		}
+		ids := make([]string, len(printed))
+		for i, inst := range printed {
+			ids[i] = inst.ID
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("expected instances %v, got %s", test.ids, out.String())
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+// The Consul catalog API is served read-only, so that Consul-aware tools such
+// as Prometheus and Envoy can watch a cluster. Each cluster is a service whose
+// name is the cluster ID, and each instance is a service instance on a node
+// named after the instance.
+const (
+	consulDatacenter = "discovery"
+
+	// consulDefaultWait and consulMaxWait bound blocking queries like Consul
+	// does.
+	consulDefaultWait = 5 * time.Minute
+	consulMaxWait     = 10 * time.Minute
+)
+
+type consulCatalogService struct {
+	ID                       string
+	Node                     string
+	Address                  string
+	Datacenter               string
+	TaggedAddresses          map[string]string
+	NodeMeta                 map[string]string
+	ServiceID                string
+	ServiceName              string
+	ServiceTags              []string
+	ServiceAddress           string
+	ServicePort              int
+	ServiceMeta              map[string]string
+	ServiceEnableTagOverride bool
+	CreateIndex              int64
+	ModifyIndex              int64
+}
+
+type consulServiceEntry struct {
+	Node    *consulNode
+	Service *consulService
+	Checks  []*consulCheck
+}
+
+type consulNode struct {
+	ID              string
+	Node            string
+	Address         string
+	Datacenter      string
+	TaggedAddresses map[string]string
+	Meta            map[string]string
+	CreateIndex     int64
+	ModifyIndex     int64
+}
+
+type consulService struct {
+	ID                string
+	Service           string
+	Tags              []string
+	Address           string
+	Port              int
+	Meta              map[string]string
+	EnableTagOverride bool
+	CreateIndex       int64
+	ModifyIndex       int64
+}
+
+type consulCheck struct {
+	Node        string
+	CheckID     string
+	Name        string
+	Status      string
+	Notes       string
+	Output      string
+	ServiceID   string
+	ServiceName string
+	ServiceTags []string
+	CreateIndex int64
+	ModifyIndex int64
+}
+
+// ConsulCatalogService lists the instances of a cluster like Consul's
+// /v1/catalog/service/<service> endpoint.
+func (s *Server) ConsulCatalogService(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	index, instances := s.consulQuery(w, req, params.ByName("cluster_id"))
+	if instances == nil {
+		return
+	}
+	services := make([]*consulCatalogService, 0, len(instances))
+	for _, inst := range instances {
+		node, service := consulInstance(inst)
+		services = append(services, &consulCatalogService{
+			ID:              node.ID,
+			Node:            node.Node,
+			Address:         node.Address,
+			Datacenter:      node.Datacenter,
+			TaggedAddresses: node.TaggedAddresses,
+			NodeMeta:        node.Meta,
+			ServiceID:       service.ID,
+			ServiceName:     service.Service,
+			ServiceTags:     service.Tags,
+			ServiceAddress:  service.Address,
+			ServicePort:     service.Port,
+			ServiceMeta:     service.Meta,
+			CreateIndex:     service.CreateIndex,
+			ModifyIndex:     service.ModifyIndex,
+		})
+	}
+	consulJSON(w, index, services)
+}
+
+// ConsulHealthService lists the instances of a cluster like Consul's
+// /v1/health/service/<service> endpoint. Registered instances are alive, so
+// each has a single passing check.
+func (s *Server) ConsulHealthService(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	index, instances := s.consulQuery(w, req, params.ByName("cluster_id"))
+	if instances == nil {
+		return
+	}
+	entries := make([]*consulServiceEntry, 0, len(instances))
+	for _, inst := range instances {
+		node, service := consulInstance(inst)
+		entries = append(entries, &consulServiceEntry{
+			Node:    node,
+			Service: service,
+			Checks: []*consulCheck{{
+				Node:        node.Node,
+				CheckID:     "service:" + service.ID,
+				Name:        "Service '" + service.Service + "' check",
+				Status:      "passing",
+				Output:      "registered with flynn-discovery",
+				ServiceID:   service.ID,
+				ServiceName: service.Service,
+				ServiceTags: service.Tags,
+				CreateIndex: service.CreateIndex,
+				ModifyIndex: service.ModifyIndex,
+			}},
+		})
+	}
+	consulJSON(w, index, entries)
+}
+
+// consulQuery returns the modification index and the instances of a cluster
+// for a Consul API request, or writes an error response and returns nil
+// instances. If the index query parameter is set, it is a blocking query that
+// waits until the index is greater or the wait query parameter elapses. Consul
+// indexes start at 1, so the Consul index is the cluster's modification index
+// plus one.
+//
+// Consul clients send their ACL token in the X-Consul-Token header or the
+// token query parameter, which is accepted as the cluster secret.
+func (s *Server) consulQuery(w http.ResponseWriter, req *http.Request, clusterID string) (int64, []*discovery.Instance) {
+	q := req.URL.Query()
+	if req.Header.Get("Authorization") == "" {
+		token := req.Header.Get("X-Consul-Token")
+		if token == "" {
+			token = q.Get("token")
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	cluster := s.getCluster(w, req, clusterID, false)
+	if cluster == nil {
+		return 0, nil
+	}
+
+	index := cluster.Index
+	if q.Get("index") != "" {
+		wait, err := strconv.ParseInt(q.Get("index"), 10, 64)
+		if err != nil {
+			httphelper.ValidationError(w, "index", "must be an integer")
+			return 0, nil
+		}
+		timeout := consulDefaultWait
+		if q.Get("wait") != "" {
+			if timeout, err = time.ParseDuration(q.Get("wait")); err != nil || timeout < 0 {
+				httphelper.ValidationError(w, "wait", "must be a duration")
+				return 0, nil
+			}
+			if timeout > consulMaxWait {
+				timeout = consulMaxWait
+			}
+		}
+		if wait > 0 && index < wait {
+			if index, err = s.waitForChange(w, clusterID, wait-1, timeout); err != nil {
+				httphelper.Error(w, err)
+				return 0, nil
+			}
+		}
+	}
+
+	instances, err := s.Backend.GetClusterInstances(clusterID)
+	countStorageError("GetClusterInstances", err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return 0, nil
+	}
+	// instances have no tags, so filtering by tag never matches
+	if q.Get("tag") != "" {
+		instances = nil
+	}
+	if instances == nil {
+		instances = []*discovery.Instance{}
+	}
+	return index, instances
+}
+
+// consulInstance returns the Consul node and service of an instance. The
+// address and port are those of the instance's URL.
+func consulInstance(inst *discovery.Instance) (*consulNode, *consulService) {
+	name := inst.Name
+	if name == "" {
+		name = inst.ID
+	}
+	host, port, _ := instanceHostPort(inst)
+	meta := map[string]string{"url": inst.URL}
+	if inst.FlynnVersion != "" {
+		meta["flynn_version"] = inst.FlynnVersion
+	}
+	node := &consulNode{
+		ID:              inst.ID,
+		Node:            name,
+		Address:         host,
+		Datacenter:      consulDatacenter,
+		TaggedAddresses: map[string]string{},
+		Meta:            map[string]string{},
+		CreateIndex:     inst.CreatedIndex + 1,
+		ModifyIndex:     inst.Index + 1,
+	}
+	service := &consulService{
+		ID:          inst.ID,
+		Service:     inst.ClusterID,
+		Tags:        []string{},
+		Address:     host,
+		Port:        int(port),
+		Meta:        meta,
+		CreateIndex: inst.CreatedIndex + 1,
+		ModifyIndex: inst.Index + 1,
+	}
+	return node, service
+}
+
+// consulJSON writes a Consul API response for the cluster modification index.
+// Consul clients require all of the headers to be present.
+func consulJSON(w http.ResponseWriter, index int64, v interface{}) {
+	w.Header().Set("X-Consul-Index", strconv.FormatInt(index+1, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", "0")
+	httphelper.JSON(w, 200, v)
+}
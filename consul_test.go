@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+// consulTestRequest serves a Consul API request with the token in the
+// X-Consul-Token header if it is set.
+func consulTestRequest(s *Server, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	res := httptest.NewRecorder()
+	s.ServeHTTP(res, req)
+	return res
+}
+
+// expectConsulIndex checks that res is a successful Consul API response with
+// the given X-Consul-Index.
+func expectConsulIndex(t *testing.T, res *httptest.ResponseRecorder, index string) {
+	if res.Code != 200 {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	if res.Header().Get("X-Consul-Index") != index {
+		t.Errorf("expected X-Consul-Index %s, got %q", index, res.Header().Get("X-Consul-Index"))
+	}
+	for _, h := range []string{"X-Consul-KnownLeader", "X-Consul-LastContact"} {
+		if res.Header().Get(h) == "" {
+			t.Errorf("expected %s to be set", h)
+		}
+	}
+}
+
+func TestConsulCatalogService(t *testing.T) {
+	s, cluster := newTestServer(t)
+	path := "/v1/catalog/service/" + cluster.ID
+
+	// Consul indexes start at 1, so an empty cluster has index 1
+	res := consulTestRequest(s, path, "")
+	expectConsulIndex(t, res, "1")
+	if body := res.Body.String(); body != "[]" {
+		t.Errorf("expected an empty list, got %s", body)
+	}
+
+	inst := createHTTPTestInstance(t, s, cluster, map[string]interface{}{"url": "http://10.0.0.1:1111", "name": "node1", "flynn_version": "v20151104.1"})
+	res = consulTestRequest(s, path, "")
+	expectConsulIndex(t, res, "2")
+	var services []*consulCatalogService
+	decodeTestResponse(t, res, &services)
+	if len(services) != 1 {
+		t.Fatalf("expected 1 service, got %s", res.Body)
+	}
+	service := services[0]
+	if service.ID != inst.ID || service.Node != "node1" || service.Address != "10.0.0.1" || service.Datacenter != consulDatacenter {
+		t.Errorf("unexpected node %+v", service)
+	}
+	if service.ServiceID != inst.ID || service.ServiceName != cluster.ID || service.ServiceAddress != "10.0.0.1" || service.ServicePort != 1111 {
+		t.Errorf("unexpected service %+v", service)
+	}
+	if service.ServiceMeta["url"] != inst.URL || service.ServiceMeta["flynn_version"] != "v20151104.1" {
+		t.Errorf("unexpected service meta %v", service.ServiceMeta)
+	}
+	if service.CreateIndex != 2 || service.ModifyIndex != 2 {
+		t.Errorf("expected create and modify index 2, got %d and %d", service.CreateIndex, service.ModifyIndex)
+	}
+
+	// instances have no tags
+	res = consulTestRequest(s, path+"?tag=web", "")
+	expectConsulIndex(t, res, "2")
+	if body := res.Body.String(); body != "[]" {
+		t.Errorf("expected no services with a tag, got %s", body)
+	}
+
+	if res := consulTestRequest(s, "/v1/catalog/service/"+newUUID(), ""); res.Code != 404 {
+		t.Errorf("expected status 404 for an unknown cluster, got %d", res.Code)
+	}
+}
+
+func TestConsulHealthService(t *testing.T) {
+	s, cluster := newTestServer(t)
+	path := "/v1/health/service/" + cluster.ID
+	inst := createHTTPTestInstance(t, s, cluster, map[string]interface{}{"url": "http://10.0.0.1:1111"})
+
+	// renaming the instance modifies it, but it keeps its create index
+	res := testRequest(s, "PATCH", "/clusters/"+cluster.ID+"/instances/"+inst.ID, inst.Secret, map[string]interface{}{"data": map[string]string{"name": "node1"}})
+	if res.Code != 200 {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+
+	res = consulTestRequest(s, path, "")
+	expectConsulIndex(t, res, "3")
+	var entries []*consulServiceEntry
+	decodeTestResponse(t, res, &entries)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %s", res.Body)
+	}
+	entry := entries[0]
+	if entry.Node.Node != "node1" || entry.Node.Address != "10.0.0.1" || entry.Service.Port != 1111 {
+		t.Errorf("unexpected entry %s", res.Body)
+	}
+	if entry.Service.CreateIndex != 2 || entry.Service.ModifyIndex != 3 {
+		t.Errorf("expected create index 2 and modify index 3, got %d and %d", entry.Service.CreateIndex, entry.Service.ModifyIndex)
+	}
+	if len(entry.Checks) != 1 || entry.Checks[0].Status != "passing" || entry.Checks[0].ServiceID != inst.ID {
+		t.Errorf("expected a passing check, got %+v", entry.Checks)
+	}
+}
+
+func TestConsulBlockingQuery(t *testing.T) {
+	s, cluster := newTestServer(t)
+	path := "/v1/health/service/" + cluster.ID
+
+	type result struct {
+		res     *httptest.ResponseRecorder
+		elapsed time.Duration
+	}
+	query := func(params string) <-chan result {
+		done := make(chan result, 1)
+		go func() {
+			start := time.Now()
+			res := consulTestRequest(s, path+"?"+params, "")
+			done <- result{res, time.Since(start)}
+		}()
+		return done
+	}
+
+	// an index older than the current one returns immediately
+	for _, index := range []string{"0", "-1"} {
+		select {
+		case r := <-query("index=" + index):
+			expectConsulIndex(t, r.res, "1")
+		case <-time.After(time.Second):
+			t.Fatalf("expected index=%s to return immediately", index)
+		}
+	}
+
+	// the current index waits until the wait time elapses
+	r := <-query("index=1&wait=100ms")
+	expectConsulIndex(t, r.res, "1")
+	if r.elapsed < 100*time.Millisecond {
+		t.Errorf("expected the query to wait 100ms, returned after %s", r.elapsed)
+	}
+
+	// or until the cluster changes
+	done := query("index=1&wait=5s")
+	select {
+	case r := <-done:
+		t.Fatalf("expected the query to block, got %d: %s", r.res.Code, r.res.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+	createHTTPTestInstance(t, s, cluster, map[string]interface{}{"url": "http://10.0.0.1:1111"})
+	select {
+	case r := <-done:
+		expectConsulIndex(t, r.res, "2")
+		var entries []*consulServiceEntry
+		decodeTestResponse(t, r.res, &entries)
+		if len(entries) != 1 {
+			t.Errorf("expected 1 entry, got %s", r.res.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the blocking query to return")
+	}
+
+	for _, test := range []struct {
+		params string
+		field  string
+	}{
+		{"index=x", "index"},
+		{"index=1&wait=x", "wait"},
+		{"index=1&wait=-1s", "wait"},
+	} {
+		expectValidationError(t, consulTestRequest(s, path+"?"+test.params, ""), test.field)
+	}
+}
+
+func TestConsulToken(t *testing.T) {
+	s, _ := newTestServer(t)
+	cluster := createHTTPTestCluster(t, s, &discovery.Cluster{Private: true})
+	createHTTPTestInstance(t, s, cluster, map[string]interface{}{"url": "http://10.0.0.1:1111"})
+	path := "/v1/catalog/service/" + cluster.ID
+
+	for _, test := range []struct {
+		name   string
+		path   string
+		token  string
+		secret string
+		status int
+	}{
+		{name: "no token", path: path, status: 401},
+		{name: "invalid token", path: path, token: "invalid", status: 401},
+		{name: "X-Consul-Token", path: path, token: cluster.Secret, status: 200},
+		{name: "token parameter", path: path + "?token=" + cluster.Secret, status: 200},
+		{name: "invalid token parameter", path: path + "?token=invalid", status: 401},
+		{name: "bearer token", path: path, secret: cluster.Secret, status: 200},
+		// the Authorization header takes precedence over the Consul token
+		{name: "invalid bearer token", path: path, token: cluster.Secret, secret: "invalid", status: 401},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", test.path, nil)
+			if test.token != "" {
+				req.Header.Set("X-Consul-Token", test.token)
+			}
+			if test.secret != "" {
+				req.Header.Set("Authorization", "Bearer "+test.secret)
+			}
+			res := httptest.NewRecorder()
+			s.ServeHTTP(res, req)
+			if res.Code != test.status {
+				t.Errorf("expected status %d, got %d: %s", test.status, res.Code, res.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/httphelper"
+)
+
+// Client is a client for the flynn-discovery API. Errors returned by the
+// server are returned as httphelper.JSONError values, so they can be checked
+// with httphelper.IsObjectNotFoundError and friends.
+type Client struct {
+	// URL is the base URL of the discovery server, without a trailing slash.
+	URL string
+
+	// Secret is the cluster secret sent with every request. It is required
+	// to register instances and to read the instances of private clusters.
+	Secret string
+
+	// Retries is the number of times a request that failed with a retryable
+	// error is retried, with exponential backoff between attempts. Only
+	// idempotent requests are retried, so that a cluster isn't created twice.
+	Retries int
+
+	HTTP *http.Client
+}
+
+// NewClient returns a client for the discovery server at uri. If uri contains
+// a password, like cluster token URLs given to cluster members do, it is used
+// as the cluster secret.
+func NewClient(uri string) (*Client, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{Retries: 5, HTTP: http.DefaultClient}
+	if u.User != nil {
+		c.Secret, _ = u.User.Password()
+		u.User = nil
+	}
+	c.URL = strings.TrimSuffix(u.String(), "/")
+	return c, nil
+}
+
+// CreateCluster creates a cluster with the size and privacy of cluster, and
+// fills in the remaining fields from the response, including the cluster
+// secret.
+func (c *Client) CreateCluster(cluster *Cluster) error {
+	res := struct {
+		Data *Cluster `json:"data"`
+	}{cluster}
+	return c.send("POST", "/clusters", res, &res, nil)
+}
+
+// RegisterInstance registers inst with the cluster and fills in the remaining
+// fields from the response, including the instance secret. If an instance
+// with the same URL is already registered, that is not considered an error:
+// inst is filled in from the existing instance without a secret. The server
+// doesn't disclose the existing instance in its 409 Conflict response, so
+// this takes an extra request to list the instances of the cluster, which
+// requires the cluster secret if the cluster is private.
+func (c *Client) RegisterInstance(clusterID string, inst *Instance) error {
+	res := struct {
+		Data *Instance `json:"data"`
+	}{inst}
+	err := c.send("POST", "/clusters/"+clusterID+"/instances", res, &res, nil)
+	if !httphelper.IsObjectExistsError(err) {
+		return err
+	}
+	instances, err := c.Instances(clusterID)
+	if err != nil {
+		return err
+	}
+	for _, existing := range instances {
+		if existing.URL == inst.URL {
+			*inst = *existing
+			return nil
+		}
+	}
+	// the existing instance was removed in the meantime
+	return c.send("POST", "/clusters/"+clusterID+"/instances", res, &res, nil)
+}
+
+// Instances returns the instances that are currently registered with the
+// cluster.
+func (c *Client) Instances(clusterID string) ([]*Instance, error) {
+	instances, _, err := c.instances(clusterID, "")
+	return instances, err
+}
+
+// InstancesWithSSHKey returns the instances of the cluster that have an SSH
+// public key with the given SHA256 fingerprint, e.g. to find the instance
+// that presented a host key.
+func (c *Client) InstancesWithSSHKey(clusterID, fingerprint string) ([]*Instance, error) {
+	instances, _, err := c.instances(clusterID, "?fingerprint="+url.QueryEscape(fingerprint))
+	return instances, err
+}
+
+// Watch blocks until the modification index of the cluster is greater than
+// index, or until the server's wait timeout elapses, and returns the
+// instances of the cluster with its current modification index. Pass the
+// returned index to the next call to wait for further changes, or -1 to
+// return immediately.
+func (c *Client) Watch(clusterID string, index int64) ([]*Instance, int64, error) {
+	return c.watch(clusterID, index, 0)
+}
+
+// watch is like Watch, but returns once timeout elapses if it is shorter than
+// the server's wait timeout.
+func (c *Client) watch(clusterID string, index int64, timeout time.Duration) ([]*Instance, int64, error) {
+	query := "?wait=true&index=" + strconv.FormatInt(index, 10)
+	if timeout > 0 {
+		query += "&timeout=" + url.QueryEscape(timeout.String())
+	}
+	return c.instances(clusterID, query)
+}
+
+// WaitForSize blocks until at least size instances are registered with the
+// cluster and returns them. An error is returned if that takes longer than
+// timeout.
+func (c *Client) WaitForSize(clusterID string, size int, timeout time.Duration) ([]*Instance, error) {
+	deadline := time.Now().Add(timeout)
+	index := int64(-1)
+	for {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			remaining = time.Millisecond
+		}
+		instances, newIndex, err := c.watch(clusterID, index, remaining)
+		if err != nil {
+			return nil, err
+		}
+		if len(instances) >= size {
+			return instances, nil
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("discovery: timed out waiting for %d instances, %d are registered", size, len(instances))
+		}
+		index = newIndex
+	}
+}
+
+func (c *Client) instances(clusterID, query string) ([]*Instance, int64, error) {
+	var res struct {
+		Data []*Instance `json:"data"`
+	}
+	header := make(http.Header)
+	if err := c.send("GET", "/clusters/"+clusterID+"/instances"+query, nil, &res, header); err != nil {
+		return nil, 0, err
+	}
+	index, _ := strconv.ParseInt(header.Get("X-Discovery-Index"), 10, 64)
+	return res.Data, index, nil
+}
+
+// send makes a request with in encoded as the JSON body and decodes the
+// response body into out, retrying retryable errors of idempotent requests.
+// If header is not nil, the response headers are copied into it.
+func (c *Client) send(method, path string, in, out interface{}, header http.Header) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := c.do(method, path, body, out, header)
+		if err == nil || attempt >= c.Retries || !isIdempotent(method) || !isRetryable(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
+func (c *Client) do(method, path string, body []byte, out interface{}, header http.Header) error {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.URL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Secret)
+	}
+
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return responseError(res)
+	}
+	if header != nil {
+		for k, v := range res.Header {
+			header[k] = v
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// responseError returns the httphelper.JSONError in the body of res, or a
+// generic one if the body doesn't contain an error.
+func responseError(res *http.Response) error {
+	data, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+	var jsonErr httphelper.JSONError
+	if err := json.Unmarshal(data, &jsonErr); err == nil && jsonErr.Code != "" {
+		return jsonErr
+	}
+	jsonErr = httphelper.JSONError{
+		Code:    httphelper.UnknownErrorCode,
+		Message: fmt.Sprintf("unexpected status %d: %s", res.StatusCode, bytes.TrimSpace(data)),
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		// most likely a proxy in front of the server
+		jsonErr.Retry = true
+	}
+	return jsonErr
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func isRetryable(err error) bool {
+	if httphelper.IsRetryableError(err) {
+		return true
+	}
+	if err, ok := err.(*url.Error); ok {
+		_, ok := err.Err.(net.Error)
+		return ok
+	}
+	return false
+}
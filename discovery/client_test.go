@@ -0,0 +1,374 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/httphelper"
+)
+
+// testServer is a minimal discovery server with a single cluster, which
+// records the requests it receives.
+type testServer struct {
+	*httptest.Server
+
+	mtx       sync.Mutex
+	secret    string
+	instances []*Instance
+	index     int64
+	changed   chan struct{} // closed and replaced when index changes
+	requests  []string      // method and path with query of each request
+
+	// conflicts is the number of registrations rejected as duplicates
+	// before the instance list is checked, as if the existing instance was
+	// deleted in the meantime
+	conflicts int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{secret: "cluster-secret", changed: make(chan struct{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) client(t *testing.T) *Client {
+	client, err := NewClient(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Secret = s.secret
+	return client
+}
+
+func (s *testServer) addInstance(inst *Instance) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.index++
+	inst.ID = "i" + strconv.Itoa(len(s.instances)+1)
+	inst.ClusterID = "c1"
+	inst.Index = s.index
+	s.instances = append(s.instances, inst)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *testServer) requestLog() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *testServer) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mtx.Lock()
+	s.requests = append(s.requests, req.Method+" "+req.URL.RequestURI())
+	s.mtx.Unlock()
+
+	switch {
+	case req.Method == "POST" && req.URL.Path == "/clusters":
+		httphelper.JSON(w, 201, map[string]*Cluster{"data": {ID: "c1", Secret: s.secret}})
+	case req.Header.Get("Authorization") != "Bearer "+s.secret:
+		httphelper.Error(w, httphelper.JSONError{Code: httphelper.UnauthorizedErrorCode, Message: "invalid secret"})
+	case req.Method == "POST" && req.URL.Path == "/clusters/c1/instances":
+		var data struct {
+			Data *Instance `json:"data"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+		s.mtx.Lock()
+		conflict := s.conflicts > 0
+		if conflict {
+			s.conflicts--
+		}
+		s.mtx.Unlock()
+		for _, inst := range s.list() {
+			if conflict || inst.URL == data.Data.URL {
+				// like the real server, don't disclose the existing instance
+				httphelper.ObjectExistsError(w, "an instance with this URL is already registered")
+				return
+			}
+		}
+		s.addInstance(data.Data)
+		inst := *data.Data
+		inst.Secret = "instance-secret"
+		httphelper.JSON(w, 201, map[string]*Instance{"data": &inst})
+	case req.Method == "GET" && req.URL.Path == "/clusters/c1/instances":
+		s.getInstances(w, req)
+	default:
+		httphelper.ObjectNotFoundError(w, "not found")
+	}
+}
+
+func (s *testServer) list() []*Instance {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]*Instance(nil), s.instances...)
+}
+
+// getInstances waits like the real server if the wait query parameter is set,
+// for at most the timeout query parameter.
+func (s *testServer) getInstances(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	if q.Get("wait") == "true" {
+		index, _ := strconv.ParseInt(q.Get("index"), 10, 64)
+		timeout := time.Minute
+		if t, err := time.ParseDuration(q.Get("timeout")); err == nil {
+			timeout = t
+		}
+		deadline := time.After(timeout)
+		for {
+			s.mtx.Lock()
+			current, changed := s.index, s.changed
+			s.mtx.Unlock()
+			if current > index {
+				break
+			}
+			select {
+			case <-changed:
+				continue
+			case <-deadline:
+			}
+			break
+		}
+	}
+
+	s.mtx.Lock()
+	index := s.index
+	s.mtx.Unlock()
+	var instances []*Instance
+	for _, inst := range s.list() {
+		if fingerprint := q.Get("fingerprint"); fingerprint != "" {
+			if len(inst.SSHPublicKeys) == 0 || inst.SSHPublicKeys[0].Fingerprint != fingerprint {
+				continue
+			}
+		}
+		instances = append(instances, inst)
+	}
+	w.Header().Set("X-Discovery-Index", strconv.FormatInt(index, 10))
+	httphelper.JSON(w, 200, map[string][]*Instance{"data": instances})
+}
+
+func TestNewClient(t *testing.T) {
+	for _, test := range []struct {
+		uri    string
+		url    string
+		secret string
+	}{
+		{"https://discovery.example.com", "https://discovery.example.com", ""},
+		{"https://discovery.example.com/", "https://discovery.example.com", ""},
+		{"https://:s3cret@discovery.example.com/prefix/", "https://discovery.example.com/prefix", "s3cret"},
+	} {
+		client, err := NewClient(test.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.URL != test.url || client.Secret != test.secret {
+			t.Errorf("%s: expected %s with secret %q, got %s with secret %q", test.uri, test.url, test.secret, client.URL, client.Secret)
+		}
+	}
+}
+
+func TestClientCreateCluster(t *testing.T) {
+	s := newTestServer(t)
+	client, err := NewClient(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster := &Cluster{Size: 3}
+	if err := client.CreateCluster(cluster); err != nil {
+		t.Fatal(err)
+	}
+	if cluster.ID != "c1" || cluster.Secret != s.secret {
+		t.Errorf("expected the cluster to be filled in, got %+v", cluster)
+	}
+}
+
+func TestClientRegisterInstance(t *testing.T) {
+	s := newTestServer(t)
+	client := s.client(t)
+	inst := &Instance{URL: "http://10.0.0.1:1111", Name: "node1"}
+	if err := client.RegisterInstance("c1", inst); err != nil {
+		t.Fatal(err)
+	}
+	if inst.ID != "i1" || inst.Secret != "instance-secret" {
+		t.Fatalf("expected instance ID and secret to be set, got %+v", inst)
+	}
+
+	// the server responds with 409 Conflict without the existing instance,
+	// which is looked up in the instance list and returned without its
+	// secret
+	again := &Instance{URL: inst.URL}
+	if err := client.RegisterInstance("c1", again); err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != inst.ID || again.Name != "node1" {
+		t.Errorf("expected existing instance %s, got %+v", inst.ID, again)
+	}
+	if again.Secret != "" {
+		t.Errorf("expected no instance secret, got %q", again.Secret)
+	}
+	expected := []string{"POST /clusters/c1/instances", "POST /clusters/c1/instances", "GET /clusters/c1/instances"}
+	if requests := s.requestLog(); strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected requests %q, got %q", expected, requests)
+	}
+
+	// the registration is sent again if the existing instance is gone
+	s.mtx.Lock()
+	s.conflicts = 1
+	s.requests = nil
+	s.mtx.Unlock()
+	inst = &Instance{URL: "http://10.0.0.2:1111"}
+	if err := client.RegisterInstance("c1", inst); err != nil {
+		t.Fatal(err)
+	}
+	if inst.ID != "i2" || inst.Secret != "instance-secret" {
+		t.Errorf("expected the instance to be registered, got %+v", inst)
+	}
+	expected = []string{"POST /clusters/c1/instances", "GET /clusters/c1/instances", "POST /clusters/c1/instances"}
+	if requests := s.requestLog(); strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected requests %q, got %q", expected, requests)
+	}
+
+	client.Secret = "invalid"
+	err := client.RegisterInstance("c1", &Instance{URL: "http://10.0.0.3:1111"})
+	if jsonErr, ok := err.(httphelper.JSONError); !ok || jsonErr.Code != httphelper.UnauthorizedErrorCode {
+		t.Errorf("expected an unauthorized error, got %v", err)
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	s := newTestServer(t)
+	client := s.client(t)
+	s.addInstance(&Instance{URL: "http://10.0.0.1:1111"})
+
+	// -1 returns immediately
+	instances, index, err := client.Watch("c1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 1 || len(instances) != 1 {
+		t.Fatalf("expected 1 instance at index 1, got %d at index %d", len(instances), index)
+	}
+
+	type result struct {
+		instances []*Instance
+		index     int64
+		err       error
+	}
+	done := make(chan result)
+	go func() {
+		instances, index, err := client.Watch("c1", index)
+		done <- result{instances, index, err}
+	}()
+	select {
+	case res := <-done:
+		t.Fatalf("expected Watch to block, got %+v", res)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	s.addInstance(&Instance{URL: "http://10.0.0.2:1111"})
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if res.index != 2 || len(res.instances) != 2 {
+			t.Errorf("expected 2 instances at index 2, got %d at index %d", len(res.instances), res.index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Watch to return")
+	}
+	if requests := s.requestLog(); requests[len(requests)-1] != "GET /clusters/c1/instances?wait=true&index=1" {
+		t.Errorf("unexpected request %q", requests[len(requests)-1])
+	}
+}
+
+func TestClientWaitForSize(t *testing.T) {
+	s := newTestServer(t)
+	client := s.client(t)
+	go func() {
+		for _, url := range []string{"http://10.0.0.1:1111", "http://10.0.0.2:1111"} {
+			time.Sleep(50 * time.Millisecond)
+			s.addInstance(&Instance{URL: url})
+		}
+	}()
+	instances, err := client.WaitForSize("c1", 2, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 2 {
+		t.Errorf("expected 2 instances, got %d", len(instances))
+	}
+
+	// the server holds requests for a minute, the remaining time is passed
+	// to it so that the timeout is respected
+	start := time.Now()
+	if _, err := client.WaitForSize("c1", 3, 200*time.Millisecond); err == nil {
+		t.Error("expected WaitForSize to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected WaitForSize to time out after 200ms, took %s", elapsed)
+	}
+	for _, req := range s.requestLog() {
+		if !strings.Contains(req, "&timeout=") {
+			t.Errorf("expected the remaining time to be passed, got %q", req)
+		}
+	}
+}
+
+func TestClientInstancesWithSSHKey(t *testing.T) {
+	s := newTestServer(t)
+	client := s.client(t)
+	s.addInstance(&Instance{URL: "http://10.0.0.1:1111", SSHPublicKeys: []SSHPublicKey{{Type: "ssh-ed25519", Fingerprint: "SHA256:a+b/c"}}})
+	s.addInstance(&Instance{URL: "http://10.0.0.2:1111"})
+
+	instances, err := client.InstancesWithSSHKey("c1", "SHA256:a+b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].ID != "i1" {
+		t.Errorf("expected instance i1, got %+v", instances)
+	}
+	if requests := s.requestLog(); requests[0] != "GET /clusters/c1/instances?fingerprint=SHA256%3Aa%2Bb%2Fc" {
+		t.Errorf("expected the fingerprint to be escaped, got %q", requests[0])
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		// a proxy in front of an unavailable server
+		http.Error(w, "no healthy upstream", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	client, err := NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Retries = 2
+
+	if err := client.CreateCluster(&Cluster{}); err == nil {
+		t.Error("expected CreateCluster to fail")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected POST not to be retried, got %d requests", n)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	if _, err := client.Instances("c1"); err == nil {
+		t.Error("expected Instances to fail")
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("expected GET to be retried twice, got %d requests", n)
+	}
+}
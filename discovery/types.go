@@ -0,0 +1,79 @@
+// Package discovery contains the types of the flynn-discovery API and a client
+// for it. Fields tagged with `json:"-"` are only used by the server.
+package discovery
+
+import "time"
+
+type Cluster struct {
+	ID               string    `json:"id"`
+	CreatorIP        string    `json:"-"`
+	CreatorUserAgent string    `json:"-"`
+	CreatedAt        time.Time `json:"created_at"`
+
+	// Secret is only set when the cluster is created or its secret is
+	// reset, only its hash is stored. Clusters created before secrets were
+	// introduced have no SecretHash.
+	Secret     string `json:"secret,omitempty"`
+	SecretHash string `json:"-"`
+
+	// Private clusters require the secret to read instances as well as to
+	// modify them.
+	Private bool `json:"private,omitempty"`
+
+	// Size is the expected number of instances in the cluster, or zero if it
+	// is unknown. Once Size instances are registered the cluster is complete
+	// and no more instances may join.
+	Size          int  `json:"size,omitempty"`
+	InstanceCount int  `json:"instance_count"`
+	Complete      bool `json:"complete"`
+
+	// Index is incremented every time an instance is added to or removed
+	// from the cluster.
+	Index int64 `json:"index"`
+
+	// ActiveAt is the last time an instance was added, changed, removed or
+	// sent a heartbeat.
+	ActiveAt time.Time `json:"-"`
+}
+
+type Instance struct {
+	ID            string         `json:"id"`
+	ClusterID     string         `json:"cluster_id"`
+	FlynnVersion  string         `json:"flynn_version,omitempty"`
+	SSHPublicKeys []SSHPublicKey `json:"ssh_public_keys,omitempty"`
+	URL           string         `json:"url,omitempty"`
+	Name          string         `json:"name,omitempty"`
+	CreatorIP     string         `json:"-"`
+	CreatedAt     *time.Time     `json:"created_at,omitempty"`
+	UpdatedAt     *time.Time     `json:"updated_at,omitempty"`
+
+	// PeerURLs are the peer URLs of an etcd member that advertises more than
+	// one, URL is the first of them.
+	PeerURLs []string `json:"peer_urls,omitempty"`
+
+	// Secret is only set when the instance is registered, only its hash is
+	// stored. It is required to modify or remove the instance. Instances
+	// registered before instance secrets were introduced have no SecretHash.
+	Secret     string `json:"secret,omitempty"`
+	SecretHash string `json:"-"`
+
+	// TTL is the number of seconds the instance stays registered without a
+	// heartbeat. Instances with a zero TTL never expire.
+	TTL       int        `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Index is the cluster's modification index when the instance was last
+	// modified, CreatedIndex is the one when it was registered.
+	Index        int64 `json:"index"`
+	CreatedIndex int64 `json:"created_index"`
+}
+
+type SSHPublicKey struct {
+	Type string `json:"type"`
+	Data []byte `json:"data"`
+
+	// Fingerprint is the SHA256 fingerprint of the key as printed by
+	// ssh-keygen -l, e.g. "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8".
+	// It is set by the server.
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/flynn/flynn-discovery/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+// dnsServer answers DNS queries for the instances of clusters. The name
+// <cluster_id>.<zone> has an A or AAAA record for each instance with an IP
+// address in its URL, an SRV record with the host and port of each instance,
+// and a TXT record with the ID, name and Flynn version of each instance.
+// <instance_id>.<cluster_id>.<zone> has the A, AAAA and TXT records of a
+// single instance, and is the SRV target of instances with an IP address.
+// Private clusters are not exposed. ANY queries are answered with NOTIMP, as
+// they would make the server an amplifier for reflection attacks.
+type dnsServer struct {
+	Backend StorageBackend
+
+	// Zone is the lower case, fully qualified domain the server is
+	// authoritative for.
+	Zone string
+
+	// TTL is the TTL of the records, instances are cached for as long.
+	TTL time.Duration
+
+	mtx       sync.Mutex
+	cache     map[string]*dnsCacheEntry // keyed by cluster ID
+	closed    bool
+	listeners []io.Closer
+
+	wg sync.WaitGroup // serve loops
+}
+
+type dnsCacheEntry struct {
+	instances []*discovery.Instance
+	found     bool
+	expires   time.Time
+}
+
+// dnsCacheSize is the number of clusters above which expired cache entries are
+// removed.
+const dnsCacheSize = 10000
+
+func newDNSServer(backend StorageBackend, zone string, ttl time.Duration) *dnsServer {
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	return &dnsServer{
+		Backend: backend,
+		Zone:    zone + ".",
+		TTL:     ttl,
+		cache:   make(map[string]*dnsCacheEntry),
+	}
+}
+
+// Start listens for queries on addr over UDP and TCP, and serves them in the
+// background.
+func (s *dnsServer) Start(addr string) error {
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	s.Serve(udp, tcp)
+	return nil
+}
+
+// Serve serves queries received on udp and tcp in the background until the
+// server is closed.
+func (s *dnsServer) Serve(udp net.PacketConn, tcp net.Listener) {
+	s.mtx.Lock()
+	s.listeners = append(s.listeners, udp, tcp)
+	s.mtx.Unlock()
+	s.wg.Add(dnsUDPWorkers + 1)
+	for i := 0; i < dnsUDPWorkers; i++ {
+		go s.serveUDP(udp)
+	}
+	go s.serveTCP(tcp)
+}
+
+// Close stops serving queries and waits until the listeners are no longer
+// used.
+func (s *dnsServer) Close() error {
+	s.mtx.Lock()
+	s.closed = true
+	listeners := s.listeners
+	s.listeners = nil
+	s.mtx.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+func (s *dnsServer) isClosed() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.closed
+}
+
+const (
+	// dnsUDPWorkers is the number of UDP queries handled concurrently, each
+	// worker reads and answers one query at a time.
+	dnsUDPWorkers = 64
+
+	// dnsTCPConns is the number of TCP connections served concurrently,
+	// further connections wait to be accepted.
+	dnsTCPConns = 256
+)
+
+// serveUDP is a worker that answers queries received on conn.
+func (s *dnsServer) serveUDP(conn net.PacketConn) {
+	defer s.wg.Done()
+	buf := make([]byte, 4096)
+	var delay time.Duration
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			delay = dnsRetryDelay(delay)
+			log.Error("error reading DNS query", "err", err, "retry_in", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if res := s.handle(buf[:n], dnsUDPSize); res != nil {
+			conn.WriteTo(res, addr)
+		}
+	}
+}
+
+func (s *dnsServer) serveTCP(l net.Listener) {
+	defer s.wg.Done()
+	conns := make(chan struct{}, dnsTCPConns)
+	var delay time.Duration
+	for {
+		conns <- struct{}{}
+		conn, err := l.Accept()
+		if err != nil {
+			<-conns
+			if s.isClosed() {
+				return
+			}
+			delay = dnsRetryDelay(delay)
+			log.Error("error accepting DNS connection", "err", err, "retry_in", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go func() {
+			s.serveTCPConn(conn)
+			<-conns
+		}()
+	}
+}
+
+// dnsRetryDelay returns how long to wait before reading from a listener again
+// after an error, given the previous delay. Like net/http, the delay doubles
+// from 5ms up to a second, so that errors like running out of file
+// descriptors don't stop the server.
+func dnsRetryDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		delay = time.Second
+	}
+	return delay
+}
+
+// serveTCPConn serves queries prefixed with their length until the client
+// closes the connection or is idle for too long.
+func (s *dnsServer) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		var size uint16
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		res := s.handle(msg, 0xffff)
+		if res == nil {
+			return
+		}
+		if _, err := conn.Write(append([]byte{byte(len(res) >> 8), byte(len(res))}, res...)); err != nil {
+			return
+		}
+	}
+}
+
+const (
+	dnsUDPSize = 512
+
+	dnsTypeA     = 1
+	dnsTypeNS    = 2
+	dnsTypeSOA   = 6
+	dnsTypeTXT   = 16
+	dnsTypeAAAA  = 28
+	dnsTypeSRV   = 33
+	dnsTypeANY   = 255
+	dnsClassINET = 1
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+)
+
+type dnsQuestion struct {
+	name  string
+	typ   uint16
+	class uint16
+}
+
+type dnsRR struct {
+	name string
+	typ  uint16
+	ttl  uint32
+	data []byte
+}
+
+type dnsMessage struct {
+	id         uint16
+	flags      uint16
+	question   *dnsQuestion
+	answer     []dnsRR
+	authority  []dnsRR
+	additional []dnsRR
+}
+
+var errInvalidDNSMessage = errors.New("invalid DNS message")
+
+// handle returns the response to the query msg, which is truncated to
+// maxSize, or nil if msg is not a query.
+func (s *dnsServer) handle(msg []byte, maxSize int) []byte {
+	if len(msg) < 12 {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 != 0 {
+		// not a query
+		return nil
+	}
+	res := &dnsMessage{
+		id: binary.BigEndian.Uint16(msg),
+		// QR, the opcode, AA and RD
+		flags: 0x8000 | flags&0x7800 | 0x0400 | flags&0x0100,
+	}
+	q, err := parseDNSQuestion(msg)
+	if err != nil {
+		res.flags |= dnsRcodeFormErr
+		return res.pack(maxSize)
+	}
+	res.question = q
+	if opcode := flags >> 11 & 0xf; opcode != 0 {
+		res.flags |= dnsRcodeNotImp
+		return res.pack(maxSize)
+	}
+	res.flags |= s.answer(res, q)
+	return res.pack(maxSize)
+}
+
+func parseDNSQuestion(msg []byte) (*dnsQuestion, error) {
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, errInvalidDNSMessage
+	}
+	var labels []string
+	i := 12
+	for {
+		if i >= len(msg) {
+			return nil, errInvalidDNSMessage
+		}
+		n := int(msg[i])
+		i++
+		if n == 0 {
+			break
+		}
+		// the question is the first name in the message, so it can't be
+		// compressed
+		if n > 63 || i+n > len(msg) {
+			return nil, errInvalidDNSMessage
+		}
+		labels = append(labels, string(msg[i:i+n]))
+		i += n
+	}
+	if i+4 > len(msg) {
+		return nil, errInvalidDNSMessage
+	}
+	return &dnsQuestion{
+		name:  strings.Join(labels, ".") + ".",
+		typ:   binary.BigEndian.Uint16(msg[i:]),
+		class: binary.BigEndian.Uint16(msg[i+2:]),
+	}, nil
+}
+
+// answer adds the records answering q to res and returns the response code.
+func (s *dnsServer) answer(res *dnsMessage, q *dnsQuestion) uint16 {
+	name := strings.ToLower(q.name)
+	if q.class != dnsClassINET || name != s.Zone && !strings.HasSuffix(name, "."+s.Zone) {
+		return dnsRcodeRefused
+	}
+	if q.typ == dnsTypeANY {
+		return dnsRcodeNotImp
+	}
+	soa := s.soa()
+	if name == s.Zone {
+		if q.typ == dnsTypeSOA {
+			res.answer = append(res.answer, soa)
+		} else {
+			res.authority = append(res.authority, soa)
+		}
+		return dnsRcodeSuccess
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, "."+s.Zone), ".")
+	clusterID, ok := normalizeUUID(labels[len(labels)-1])
+	if !ok || len(labels) > 2 {
+		res.authority = append(res.authority, soa)
+		return dnsRcodeNXDomain
+	}
+	instances, found, err := s.clusterInstances(clusterID)
+	if err != nil {
+		log.Error("error getting instances for DNS query", "cluster_id", clusterID, "err", err)
+		return dnsRcodeServFail
+	}
+	if !found {
+		res.authority = append(res.authority, soa)
+		return dnsRcodeNXDomain
+	}
+
+	clusterName := clusterID + "." + s.Zone
+	if len(labels) == 2 {
+		instanceID, _ := normalizeUUID(labels[0])
+		var inst *discovery.Instance
+		for _, i := range instances {
+			if i.ID == instanceID {
+				inst = i
+			}
+		}
+		if inst == nil {
+			res.authority = append(res.authority, soa)
+			return dnsRcodeNXDomain
+		}
+		instances = []*discovery.Instance{inst}
+	}
+
+	for _, inst := range instances {
+		host, port, ok := instanceHostPort(inst)
+		if !ok {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip != nil {
+			if rr, ok := s.addressRR(q.name, ip); ok && q.typ == rr.typ {
+				res.answer = append(res.answer, rr)
+			}
+		}
+		if q.typ == dnsTypeTXT {
+			res.answer = append(res.answer, s.txtRR(q.name, inst))
+		}
+		if len(labels) == 1 && q.typ == dnsTypeSRV {
+			target := host + "."
+			if ip != nil {
+				target = inst.ID + "." + clusterName
+				if rr, ok := s.addressRR(target, ip); ok {
+					res.additional = append(res.additional, rr)
+				}
+			}
+			if rr, ok := s.srvRR(q.name, target, port); ok {
+				res.answer = append(res.answer, rr)
+			}
+		}
+	}
+	if len(res.answer) == 0 {
+		res.authority = append(res.authority, soa)
+	}
+	return dnsRcodeSuccess
+}
+
+// clusterInstances returns the instances of a cluster from the cache, or
+// from the backend if they are not cached. found is false if the cluster does
+// not exist or is private.
+func (s *dnsServer) clusterInstances(clusterID string) (instances []*discovery.Instance, found bool, err error) {
+	now := time.Now()
+	s.mtx.Lock()
+	if entry, ok := s.cache[clusterID]; ok && now.Before(entry.expires) {
+		s.mtx.Unlock()
+		return entry.instances, entry.found, nil
+	}
+	s.mtx.Unlock()
+
+	cluster, err := s.Backend.GetCluster(clusterID)
+	countStorageError("GetCluster", err)
+	if err != nil && err != ErrNotFound {
+		return nil, false, err
+	}
+	found = err == nil && !(cluster.Private && cluster.SecretHash != "")
+	if found {
+		instances, err = s.Backend.GetClusterInstances(clusterID)
+		countStorageError("GetClusterInstances", err)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.cache) >= dnsCacheSize {
+		for id, entry := range s.cache {
+			if now.After(entry.expires) {
+				delete(s.cache, id)
+			}
+		}
+	}
+	s.cache[clusterID] = &dnsCacheEntry{instances: instances, found: found, expires: now.Add(s.TTL)}
+	return instances, found, nil
+}
+
+// instanceHostPort returns the host and port of the instance's URL, using
+// the default port of the scheme if there is none.
+func instanceHostPort(inst *discovery.Instance) (string, uint16, bool) {
+	u, err := url.Parse(inst.URL)
+	if err != nil {
+		return "", 0, false
+	}
+	host, portStr, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(u.Host, "["), "]")
+		switch u.Scheme {
+		case "http":
+			portStr = "80"
+		case "https":
+			portStr = "443"
+		default:
+			return "", 0, false
+		}
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || host == "" {
+		return "", 0, false
+	}
+	return host, uint16(port), true
+}
+
+func (s *dnsServer) ttl() uint32 {
+	return uint32(s.TTL / time.Second)
+}
+
+func (s *dnsServer) addressRR(name string, ip net.IP) (dnsRR, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return dnsRR{name: name, typ: dnsTypeA, ttl: s.ttl(), data: ip4}, true
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return dnsRR{name: name, typ: dnsTypeAAAA, ttl: s.ttl(), data: ip16}, true
+	}
+	return dnsRR{}, false
+}
+
+func (s *dnsServer) txtRR(name string, inst *discovery.Instance) dnsRR {
+	var data []byte
+	for _, str := range []string{"id=" + inst.ID, "name=" + inst.Name, "flynn_version=" + inst.FlynnVersion} {
+		if len(str) > 255 {
+			str = str[:255]
+		}
+		data = append(data, byte(len(str)))
+		data = append(data, str...)
+	}
+	return dnsRR{name: name, typ: dnsTypeTXT, ttl: s.ttl(), data: data}
+}
+
+func (s *dnsServer) srvRR(name, target string, port uint16) (dnsRR, bool) {
+	encoded, ok := encodeDNSName(target)
+	if !ok {
+		return dnsRR{}, false
+	}
+	// priority and weight are equal for all instances
+	data := []byte{0, 0, 0, 0, byte(port >> 8), byte(port)}
+	return dnsRR{name: name, typ: dnsTypeSRV, ttl: s.ttl(), data: append(data, encoded...)}, true
+}
+
+func (s *dnsServer) soa() dnsRR {
+	mname, _ := encodeDNSName(s.Zone)
+	rname, _ := encodeDNSName("hostmaster." + s.Zone)
+	data := append(mname, rname...)
+	for _, v := range []uint32{
+		1,       // serial
+		3600,    // refresh
+		600,     // retry
+		86400,   // expire
+		s.ttl(), // minimum, the TTL of negative responses
+	} {
+		data = append(data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return dnsRR{name: s.Zone, typ: dnsTypeSOA, ttl: s.ttl(), data: data}
+}
+
+// encodeDNSName encodes a fully qualified name as a sequence of labels.
+func encodeDNSName(name string) ([]byte, bool) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, false
+	}
+	var buf []byte
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, false
+			}
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, label...)
+		}
+	}
+	return append(buf, 0), true
+}
+
+// pack encodes the message. If it is larger than maxSize the additional
+// records are dropped, and if it is still too large the answer is truncated
+// so that the client retries over TCP.
+func (m *dnsMessage) pack(maxSize int) []byte {
+	buf := m.packSections(m.answer, m.authority, m.additional)
+	if len(buf) > maxSize {
+		buf = m.packSections(m.answer, m.authority, nil)
+	}
+	if len(buf) > maxSize {
+		m.flags |= 0x0200 // TC
+		buf = m.packSections(nil, nil, nil)
+	}
+	return buf
+}
+
+func (m *dnsMessage) packSections(sections ...[]dnsRR) []byte {
+	buf := make([]byte, 12, dnsUDPSize)
+	binary.BigEndian.PutUint16(buf, m.id)
+	binary.BigEndian.PutUint16(buf[2:], m.flags)
+	if m.question != nil {
+		name, ok := encodeDNSName(m.question.name)
+		if ok {
+			binary.BigEndian.PutUint16(buf[4:], 1)
+			buf = append(buf, name...)
+			buf = append(buf, byte(m.question.typ>>8), byte(m.question.typ), byte(m.question.class>>8), byte(m.question.class))
+		}
+	}
+	for i, rrs := range sections {
+		count := 0
+		for _, rr := range rrs {
+			name, ok := encodeDNSName(rr.name)
+			if !ok {
+				continue
+			}
+			buf = append(buf, name...)
+			buf = append(buf, byte(rr.typ>>8), byte(rr.typ), 0, dnsClassINET)
+			buf = append(buf, byte(rr.ttl>>24), byte(rr.ttl>>16), byte(rr.ttl>>8), byte(rr.ttl))
+			buf = append(buf, byte(len(rr.data)>>8), byte(len(rr.data)))
+			buf = append(buf, rr.data...)
+			count++
+		}
+		binary.BigEndian.PutUint16(buf[6+2*i:], uint16(count))
+	}
+	return buf
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+// dnsQuery returns a query for name and typ with the given opcode.
+func dnsQuery(name string, typ uint16, opcode uint16) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg, 0x1234)
+	binary.BigEndian.PutUint16(msg[2:], opcode<<11|0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	encoded, _ := encodeDNSName(name)
+	msg = append(msg, encoded...)
+	return append(msg, byte(typ>>8), byte(typ), 0, dnsClassINET)
+}
+
+// parseDNSResponse decodes a response of the server, whose names are never
+// compressed.
+func parseDNSResponse(t *testing.T, msg []byte) *dnsMessage {
+	if len(msg) < 12 {
+		t.Fatalf("response too short: %x", msg)
+	}
+	res := &dnsMessage{
+		id:    binary.BigEndian.Uint16(msg),
+		flags: binary.BigEndian.Uint16(msg[2:]),
+	}
+	i := 12
+	readName := func() string {
+		var labels []string
+		for {
+			if i >= len(msg) {
+				t.Fatalf("truncated name in %x", msg)
+			}
+			n := int(msg[i])
+			i++
+			if n == 0 {
+				return strings.Join(labels, ".") + "."
+			}
+			labels = append(labels, string(msg[i:i+n]))
+			i += n
+		}
+	}
+	if binary.BigEndian.Uint16(msg[4:]) == 1 {
+		res.question = &dnsQuestion{name: readName()}
+		res.question.typ = binary.BigEndian.Uint16(msg[i:])
+		res.question.class = binary.BigEndian.Uint16(msg[i+2:])
+		i += 4
+	}
+	for s, section := range []*[]dnsRR{&res.answer, &res.authority, &res.additional} {
+		for n := binary.BigEndian.Uint16(msg[6+2*s:]); n > 0; n-- {
+			rr := dnsRR{name: readName()}
+			rr.typ = binary.BigEndian.Uint16(msg[i:])
+			rr.ttl = binary.BigEndian.Uint32(msg[i+4:])
+			length := int(binary.BigEndian.Uint16(msg[i+8:]))
+			i += 10
+			rr.data = msg[i : i+length]
+			i += length
+			*section = append(*section, rr)
+		}
+	}
+	if i != len(msg) {
+		t.Fatalf("%d trailing bytes in response", len(msg)-i)
+	}
+	return res
+}
+
+// rrStrings formats the data of records for comparison.
+func rrStrings(rrs []dnsRR) []string {
+	var strs []string
+	for _, rr := range rrs {
+		var s string
+		switch rr.typ {
+		case dnsTypeA, dnsTypeAAAA:
+			s = net.IP(rr.data).String()
+		case dnsTypeSRV:
+			target, _ := decodeTestDNSName(rr.data[6:])
+			s = fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rr.data[4:]), target)
+		case dnsTypeTXT:
+			var parts []string
+			for data := rr.data; len(data) > 0; data = data[1+int(data[0]):] {
+				parts = append(parts, string(data[1:1+int(data[0])]))
+			}
+			s = strings.Join(parts, " ")
+		case dnsTypeSOA:
+			mname, _ := decodeTestDNSName(rr.data)
+			s = "SOA " + mname
+		}
+		strs = append(strs, rr.name+" "+s)
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+func decodeTestDNSName(data []byte) (string, int) {
+	var labels []string
+	i := 0
+	for data[i] != 0 {
+		labels = append(labels, string(data[i+1:i+1+int(data[i])]))
+		i += 1 + int(data[i])
+	}
+	return strings.Join(labels, ".") + ".", i + 1
+}
+
+func TestDNSServer(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := newDNSServer(backend, "Discovery.Local", 10*time.Second)
+
+	cluster := createTestCluster(t, backend)
+	var instances []*discovery.Instance
+	for _, inst := range []*discovery.Instance{
+		{URL: "http://10.0.0.1:1111", Name: "node1", FlynnVersion: "v20151104.1"},
+		{URL: "https://[2001:db8::1]", Name: "node2"},
+		{URL: "http://node3.example.com:8080"},
+	} {
+		inst.ClusterID = cluster.ID
+		if err := backend.CreateInstance(inst); err != nil {
+			t.Fatal(err)
+		}
+		instances = append(instances, inst)
+	}
+	private := &discovery.Cluster{Private: true}
+	_, private.SecretHash = newSecret()
+	if err := backend.CreateCluster(private); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.CreateInstance(&discovery.Instance{ClusterID: private.ID, URL: "http://10.0.0.9:1111"}); err != nil {
+		t.Fatal(err)
+	}
+
+	zone := "discovery.local."
+	clusterName := cluster.ID + "." + zone
+	node1 := instances[0].ID + "." + clusterName
+	node2 := instances[1].ID + "." + clusterName
+	soa := []string{zone + " SOA " + zone}
+	chaosQuery := dnsQuery(clusterName, dnsTypeA, 0)
+	chaosQuery[len(chaosQuery)-1] = 3
+
+	for _, test := range []struct {
+		name       string
+		query      []byte
+		rcode      uint16
+		answer     []string
+		authority  []string
+		additional []string
+	}{
+		{
+			name:   "A",
+			query:  dnsQuery(clusterName, dnsTypeA, 0),
+			answer: []string{clusterName + " 10.0.0.1"},
+		},
+		{
+			name:   "AAAA",
+			query:  dnsQuery(clusterName, dnsTypeAAAA, 0),
+			answer: []string{clusterName + " 2001:db8::1"},
+		},
+		{
+			name:  "TXT",
+			query: dnsQuery(clusterName, dnsTypeTXT, 0),
+			answer: []string{
+				clusterName + " id=" + instances[0].ID + " name=node1 flynn_version=v20151104.1",
+				clusterName + " id=" + instances[1].ID + " name=node2 flynn_version=",
+				clusterName + " id=" + instances[2].ID + " name= flynn_version=",
+			},
+		},
+		{
+			name:  "SRV",
+			query: dnsQuery(clusterName, dnsTypeSRV, 0),
+			answer: []string{
+				clusterName + " 1111 " + node1,
+				clusterName + " 443 " + node2,
+				clusterName + " 8080 node3.example.com.",
+			},
+			additional: []string{node1 + " 10.0.0.1", node2 + " 2001:db8::1"},
+		},
+		{
+			name:   "upper case",
+			query:  dnsQuery(strings.ToUpper(clusterName), dnsTypeA, 0),
+			answer: []string{strings.ToUpper(clusterName) + " 10.0.0.1"},
+		},
+		{
+			name:   "instance A",
+			query:  dnsQuery(node1, dnsTypeA, 0),
+			answer: []string{node1 + " 10.0.0.1"},
+		},
+		{
+			name:      "instance without record",
+			query:     dnsQuery(node1, dnsTypeAAAA, 0),
+			authority: soa,
+		},
+		{
+			name:      "instance SRV",
+			query:     dnsQuery(node1, dnsTypeSRV, 0),
+			authority: soa,
+		},
+		{
+			name:      "unknown instance",
+			query:     dnsQuery(random.UUID()+"."+clusterName, dnsTypeA, 0),
+			rcode:     dnsRcodeNXDomain,
+			authority: soa,
+		},
+		{
+			name:      "unknown cluster",
+			query:     dnsQuery(random.UUID()+"."+zone, dnsTypeA, 0),
+			rcode:     dnsRcodeNXDomain,
+			authority: soa,
+		},
+		{
+			name:      "not a cluster ID",
+			query:     dnsQuery("foo."+zone, dnsTypeA, 0),
+			rcode:     dnsRcodeNXDomain,
+			authority: soa,
+		},
+		{
+			name:      "too many labels",
+			query:     dnsQuery("foo."+node1, dnsTypeA, 0),
+			rcode:     dnsRcodeNXDomain,
+			authority: soa,
+		},
+		{
+			name:      "private cluster",
+			query:     dnsQuery(private.ID+"."+zone, dnsTypeA, 0),
+			rcode:     dnsRcodeNXDomain,
+			authority: soa,
+		},
+		{
+			name:   "zone SOA",
+			query:  dnsQuery(zone, dnsTypeSOA, 0),
+			answer: soa,
+		},
+		{
+			name:      "zone A",
+			query:     dnsQuery(zone, dnsTypeA, 0),
+			authority: soa,
+		},
+		{
+			name:  "ANY",
+			query: dnsQuery(clusterName, dnsTypeANY, 0),
+			rcode: dnsRcodeNotImp,
+		},
+		{
+			name:  "zone ANY",
+			query: dnsQuery(zone, dnsTypeANY, 0),
+			rcode: dnsRcodeNotImp,
+		},
+		{
+			name:  "other zone",
+			query: dnsQuery("example.com.", dnsTypeA, 0),
+			rcode: dnsRcodeRefused,
+		},
+		{
+			name:  "zone suffix",
+			query: dnsQuery("notdiscovery.local.", dnsTypeA, 0),
+			rcode: dnsRcodeRefused,
+		},
+		{
+			name:  "other class",
+			query: chaosQuery,
+			rcode: dnsRcodeRefused,
+		},
+		{
+			name:  "other opcode",
+			query: dnsQuery(clusterName, dnsTypeA, 2), // STATUS
+			rcode: dnsRcodeNotImp,
+		},
+		{
+			name:  "malformed",
+			query: dnsQuery(clusterName, dnsTypeA, 0)[:20],
+			rcode: dnsRcodeFormErr,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			res := parseDNSResponse(t, s.handle(test.query, 65535))
+			if res.id != 0x1234 {
+				t.Errorf("expected ID 0x1234, got %#x", res.id)
+			}
+			if res.flags&0x8000 == 0 || res.flags&0x0400 == 0 {
+				t.Errorf("expected QR and AA flags, got %#x", res.flags)
+			}
+			if rcode := res.flags & 0xf; rcode != test.rcode {
+				t.Errorf("expected rcode %d, got %d", test.rcode, rcode)
+			}
+			for _, section := range []struct {
+				name     string
+				rrs      []dnsRR
+				expected []string
+			}{
+				{"answer", res.answer, test.answer},
+				{"authority", res.authority, test.authority},
+				{"additional", res.additional, test.additional},
+			} {
+				sort.Strings(section.expected)
+				if actual := rrStrings(section.rrs); !reflect.DeepEqual(actual, section.expected) {
+					t.Errorf("expected %s section %q, got %q", section.name, section.expected, actual)
+				}
+			}
+			for _, rr := range res.answer {
+				if rr.ttl != 10 {
+					t.Errorf("expected TTL 10, got %d", rr.ttl)
+				}
+			}
+		})
+	}
+
+	// responses are not answered
+	response := dnsQuery(clusterName, dnsTypeA, 0)
+	response[2] |= 0x80
+	if res := s.handle(response, dnsUDPSize); res != nil {
+		t.Errorf("expected no answer to a response, got %x", res)
+	}
+}
+
+func TestParseDNSQuestion(t *testing.T) {
+	valid := dnsQuery("abc.discovery.local.", dnsTypeSRV, 0)
+	twoQuestions := append([]byte{}, valid...)
+	twoQuestions[5] = 2
+	longLabel := dnsQuery(strings.Repeat("a", 64)+".local.", dnsTypeA, 0)
+	longLabel[12] = 64
+
+	for _, test := range []struct {
+		name     string
+		msg      []byte
+		expected *dnsQuestion
+	}{
+		{"valid", valid, &dnsQuestion{name: "abc.discovery.local.", typ: dnsTypeSRV, class: dnsClassINET}},
+		{"root", dnsQuery(".", dnsTypeSOA, 0), &dnsQuestion{name: ".", typ: dnsTypeSOA, class: dnsClassINET}},
+		{"no question", valid[:12], nil},
+		{"two questions", twoQuestions, nil},
+		{"truncated name", valid[:16], nil},
+		{"missing type", valid[:len(valid)-4], nil},
+		{"truncated class", valid[:len(valid)-1], nil},
+		{"long label", longLabel, nil},
+		{"compressed name", append(valid[:12:12], 0xc0, 0x0c, 0, 1, 0, 1), nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			q, err := parseDNSQuestion(test.msg)
+			if test.expected == nil {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", q)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(q, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, q)
+			}
+		})
+	}
+}
+
+func TestDNSTruncation(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := newDNSServer(backend, "discovery.local.", 10*time.Second)
+	cluster := createTestCluster(t, backend)
+	for i := 0; i < 20; i++ {
+		inst := &discovery.Instance{ClusterID: cluster.ID, URL: fmt.Sprintf("http://10.0.0.%d:1111", i+1)}
+		if err := backend.CreateInstance(inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	query := dnsQuery(cluster.ID+".discovery.local.", dnsTypeSRV, 0)
+
+	// over TCP everything fits
+	res := parseDNSResponse(t, s.handle(query, 65535))
+	if len(res.answer) != 20 || len(res.additional) != 20 || res.flags&0x0200 != 0 {
+		t.Errorf("expected 20 answers and additional records without TC, got %d and %d with flags %#x", len(res.answer), len(res.additional), res.flags)
+	}
+
+	// the additional records are dropped first
+	full := s.handle(query, 65535)
+	withoutAdditional := len(full) - 20*(len(res.additional[0].name)+1+10+4)
+	msg := s.handle(query, withoutAdditional)
+	if len(msg) > withoutAdditional {
+		t.Errorf("expected at most %d bytes, got %d", withoutAdditional, len(msg))
+	}
+	res = parseDNSResponse(t, msg)
+	if len(res.answer) != 20 || len(res.additional) != 0 || res.flags&0x0200 != 0 {
+		t.Errorf("expected 20 answers without additional records or TC, got %d and %d with flags %#x", len(res.answer), len(res.additional), res.flags)
+	}
+
+	// then the answer is truncated, so that the client retries over TCP
+	msg = s.handle(query, dnsUDPSize)
+	if len(msg) > dnsUDPSize {
+		t.Errorf("expected at most %d bytes, got %d", dnsUDPSize, len(msg))
+	}
+	res = parseDNSResponse(t, msg)
+	if len(res.answer) != 0 || res.flags&0x0200 == 0 {
+		t.Errorf("expected a truncated response, got %d answers with flags %#x", len(res.answer), res.flags)
+	}
+	if res.question == nil || res.question.typ != dnsTypeSRV {
+		t.Errorf("expected the question in the truncated response, got %+v", res.question)
+	}
+}
+
+// flakyPacketConn fails the first read, like a socket that ran out of buffer
+// space.
+type flakyPacketConn struct {
+	net.PacketConn
+	failed int32
+}
+
+func (c *flakyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if atomic.CompareAndSwapInt32(&c.failed, 0, 1) {
+		return 0, nil, errors.New("read failed")
+	}
+	return c.PacketConn.ReadFrom(b)
+}
+
+// flakyListener fails the first accept, like a process that ran out of file
+// descriptors.
+type flakyListener struct {
+	net.Listener
+	failed int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if atomic.CompareAndSwapInt32(&l.failed, 0, 1) {
+		return nil, errors.New("accept failed")
+	}
+	return l.Listener.Accept()
+}
+
+func TestDNSServe(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := newDNSServer(backend, "discovery.local", 10*time.Second)
+	cluster := createTestCluster(t, backend)
+	if err := backend.CreateInstance(&discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.1:1111"}); err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		udp.Close()
+		t.Fatal(err)
+	}
+	// read and accept errors are retried
+	s.Serve(&flakyPacketConn{PacketConn: udp}, &flakyListener{Listener: tcp})
+	query := dnsQuery(cluster.ID+".discovery.local.", dnsTypeA, 0)
+	expectAnswer := func(msg []byte) {
+		if res := parseDNSResponse(t, msg); len(res.answer) != 1 || net.IP(res.answer[0].data).String() != "10.0.0.1" {
+			t.Errorf("expected an A record of 10.0.0.1, got %+v", res.answer)
+		}
+	}
+
+	conn, err := net.Dial("udp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, dnsUDPSize)
+	// the first query may be dropped by the failing read
+	for i := 0; ; i++ {
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err == nil {
+			expectAnswer(buf[:n])
+			break
+		}
+		if i == 10 {
+			t.Fatalf("error reading UDP response: %s", err)
+		}
+	}
+
+	conn, err = net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)); err != nil {
+		t.Fatal(err)
+	}
+	var size uint16
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		t.Fatalf("error reading TCP response: %s", err)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		t.Fatalf("error reading TCP response: %s", err)
+	}
+	expectAnswer(msg)
+
+	// closing the server stops the serve loops
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the server to close")
+	}
+}
+
+func TestDNSRetryDelay(t *testing.T) {
+	var delays []time.Duration
+	var delay time.Duration
+	for i := 0; i < 10; i++ {
+		delay = dnsRetryDelay(delay)
+		delays = append(delays, delay)
+	}
+	expected := []time.Duration{5, 10, 20, 40, 80, 160, 320, 640, 1000, 1000}
+	for i := range expected {
+		expected[i] *= time.Millisecond
+	}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("expected delays %v, got %v", expected, delays)
+	}
+}
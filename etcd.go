@@ -0,0 +1,473 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+// The etcd v2 discovery protocol is served under etcdRegistryPath, so that a
+// cluster can be used as the discovery URL of etcd:
+//
+//	http://discovery.example.com/v2/keys/_etcd/registry/<cluster_id>
+//
+// The token is the cluster ID, _config/size is the cluster size and each
+// member key is an instance whose value is "<name>=<peer_url>", repeated and
+// separated by commas for members with several peer URLs. Members registered
+// through this API get an instance ID derived from the cluster ID and the
+// member ID, so that the member ID can be returned as the key, other
+// instances are listed with their instance ID as the key.
+const etcdRegistryPath = "/v2/keys/_etcd/registry/"
+
+// etcd error codes, see https://github.com/coreos/etcd/blob/release-2.3/error/error.go
+const (
+	etcdErrKeyNotFound  = 100
+	etcdErrNodeExist    = 105
+	etcdErrRootROnly    = 107
+	etcdErrUnauthorized = 110
+	etcdErrInvalidField = 209
+	etcdErrRaftInternal = 300
+)
+
+type etcdNode struct {
+	Key           string      `json:"key"`
+	Value         string      `json:"value,omitempty"`
+	Dir           bool        `json:"dir,omitempty"`
+	Nodes         []*etcdNode `json:"nodes,omitempty"`
+	Expiration    *time.Time  `json:"expiration,omitempty"`
+	TTL           int64       `json:"ttl,omitempty"`
+	ModifiedIndex int64       `json:"modifiedIndex,omitempty"`
+	CreatedIndex  int64       `json:"createdIndex,omitempty"`
+}
+
+type etcdResponse struct {
+	Action   string    `json:"action"`
+	Node     *etcdNode `json:"node"`
+	PrevNode *etcdNode `json:"prevNode,omitempty"`
+}
+
+type etcdError struct {
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+	Cause     string `json:"cause,omitempty"`
+	Index     int64  `json:"index"`
+}
+
+// etcdRequest is a parsed request for a key of a cluster.
+type etcdRequest struct {
+	cluster *discovery.Cluster
+	path    []string // the key below the cluster's directory
+	key     string   // the full key, as returned by etcd
+}
+
+// NewEtcdToken creates a cluster like discovery.etcd.io/new and returns its
+// etcd discovery URL. The expected number of members is given by the size
+// query parameter, which defaults to 3. The cluster has no secret, anyone who
+// knows the discovery URL can register members.
+func (s *Server) NewEtcdToken(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if !s.takeRateLimit(w, req, "clusters", s.ClusterLimit) {
+		return
+	}
+	size := 3
+	if q := req.URL.Query().Get("size"); q != "" {
+		var err error
+		if size, err = strconv.Atoi(q); err != nil || size < 1 {
+			httphelper.ValidationError(w, "size", "must be a positive integer")
+			return
+		}
+	}
+	cluster := &discovery.Cluster{
+		CreatorIP:        sourceIP(req),
+		CreatorUserAgent: req.Header.Get("User-Agent"),
+		Size:             size,
+	}
+	if len(cluster.CreatorUserAgent) > 1000 {
+		cluster.CreatorUserAgent = cluster.CreatorUserAgent[:1000]
+	}
+	err := s.Backend.CreateCluster(cluster)
+	countStorageError("CreateCluster", err)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	clustersCreated.inc()
+
+	baseURL := s.URL
+	if baseURL == "" {
+		baseURL = "http://" + req.Host
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, strings.TrimSuffix(baseURL, "/")+etcdRegistryPath+cluster.ID)
+}
+
+// EtcdGet returns a key of a cluster, or waits for the next change to the
+// cluster if the wait query parameter is true.
+func (s *Server) EtcdGet(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	r := s.etcdRequest(w, req, params, false)
+	if r == nil {
+		return
+	}
+	if req.URL.Query().Get("wait") == "true" {
+		s.etcdWait(w, req, r)
+		return
+	}
+
+	cluster := r.cluster
+	switch {
+	case len(r.path) == 0:
+		instances, err := s.Backend.GetClusterInstances(cluster.ID)
+		countStorageError("GetClusterInstances", err)
+		if err != nil {
+			etcdInternalError(w, err, cluster.Index)
+			return
+		}
+		node := &etcdNode{Key: r.key, Dir: true, ModifiedIndex: cluster.Index, CreatedIndex: 1}
+		if cluster.Size > 0 {
+			node.Nodes = append(node.Nodes, &etcdNode{Key: r.key + "/_config", Dir: true, ModifiedIndex: 1, CreatedIndex: 1})
+		}
+		for _, inst := range instances {
+			node.Nodes = append(node.Nodes, etcdInstanceNode(r.key, cluster.ID, inst))
+		}
+		etcdJSON(w, 200, cluster.Index, &etcdResponse{Action: "get", Node: node})
+	case r.path[0] == "_config":
+		if cluster.Size == 0 || len(r.path) > 2 || len(r.path) == 2 && r.path[1] != "size" {
+			etcdNotFound(w, r.key, cluster.Index)
+			return
+		}
+		size := &etcdNode{Key: etcdKeyPath(cluster.ID, "_config", "size"), Value: strconv.Itoa(cluster.Size), ModifiedIndex: 1, CreatedIndex: 1}
+		node := size
+		if len(r.path) == 1 {
+			node = &etcdNode{Key: r.key, Dir: true, Nodes: []*etcdNode{size}, ModifiedIndex: 1, CreatedIndex: 1}
+		}
+		etcdJSON(w, 200, cluster.Index, &etcdResponse{Action: "get", Node: node})
+	default:
+		inst := s.etcdMember(w, r)
+		if inst == nil {
+			return
+		}
+		etcdJSON(w, 200, cluster.Index, &etcdResponse{Action: "get", Node: etcdInstanceNode(etcdKeyPath(cluster.ID), cluster.ID, inst)})
+	}
+}
+
+// etcdWait responds with the first change to the cluster with an index of at
+// least the waitIndex query parameter, or the next change if it is not given.
+// It waits until there is one or the client goes away.
+func (s *Server) etcdWait(w http.ResponseWriter, req *http.Request, r *etcdRequest) {
+	waitIndex := r.cluster.Index + 1
+	if q := req.URL.Query().Get("waitIndex"); q != "" {
+		var err error
+		if waitIndex, err = strconv.ParseInt(q, 10, 64); err != nil {
+			etcdErrorResponse(w, 400, etcdErrInvalidField, "Invalid field", "invalid value for waitIndex", r.cluster.Index)
+			return
+		}
+	}
+
+	updates, stop := s.Backend.SubscribeCluster(r.cluster.ID)
+	defer stop()
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	for {
+		events, err := s.Backend.GetEvents(r.cluster.ID, waitIndex-1)
+		countStorageError("GetEvents", err)
+		if err != nil {
+			etcdInternalError(w, err, r.cluster.Index)
+			return
+		}
+		if len(events) > 0 {
+			event := events[0]
+			node := etcdInstanceNode(etcdKeyPath(r.cluster.ID), r.cluster.ID, event.Instance)
+			node.ModifiedIndex = event.ID
+			res := &etcdResponse{Node: node}
+			switch event.Type {
+			case EventInstanceCreated:
+				res.Action = "create"
+			case EventInstanceUpdated:
+				res.Action = "set"
+			case EventInstanceDeleted:
+				res.Action = "delete"
+			case EventInstanceExpired:
+				res.Action = "expire"
+			}
+			if res.Action == "delete" || res.Action == "expire" {
+				res.PrevNode = node
+				res.Node = &etcdNode{Key: node.Key, ModifiedIndex: event.ID, CreatedIndex: node.CreatedIndex}
+			}
+			etcdJSON(w, 200, event.ID, res)
+			return
+		}
+		select {
+		case <-updates:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// EtcdPut registers a member with a cluster. The value form parameter must be
+// "<name>=<peer_url>[,<name>=<peer_url>...]" like the members of etcd's
+// initial cluster, and the ttl form parameter optionally sets the instance
+// TTL. Members can't be changed once they are registered.
+func (s *Server) EtcdPut(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if !s.takeRateLimit(w, req, "instances", s.InstanceLimit) {
+		return
+	}
+	r := s.etcdRequest(w, req, params, true)
+	if r == nil {
+		return
+	}
+	cluster := r.cluster
+	if len(r.path) == 0 || r.path[0] == "_config" {
+		etcdErrorResponse(w, 403, etcdErrRootROnly, "Root is read only", "only members can be registered, the cluster size is set when the token is created", cluster.Index)
+		return
+	}
+	if len(r.path) > 1 {
+		etcdErrorResponse(w, 403, etcdErrRootROnly, "Root is read only", "members must be registered directly below the cluster", cluster.Index)
+		return
+	}
+	instanceID, ok := etcdInstanceID(cluster.ID, r.path[0])
+	if !ok {
+		etcdErrorResponse(w, 400, etcdErrInvalidField, "Invalid field", "the key must be an etcd member ID", cluster.Index)
+		return
+	}
+
+	name, urls, msg := parseEtcdMember(req.FormValue("value"))
+	if msg != "" {
+		etcdErrorResponse(w, 400, etcdErrInvalidField, "Invalid field", msg, cluster.Index)
+		return
+	}
+	inst := &discovery.Instance{
+		ID:        instanceID,
+		ClusterID: cluster.ID,
+		Name:      name,
+		URL:       urls[0],
+		CreatorIP: sourceIP(req),
+	}
+	if len(urls) > 1 {
+		inst.PeerURLs = urls
+	}
+	if ttl := req.FormValue("ttl"); ttl != "" {
+		var err error
+		if inst.TTL, err = strconv.Atoi(ttl); err != nil {
+			etcdErrorResponse(w, 400, etcdErrInvalidField, "Invalid field", "invalid value for ttl", cluster.Index)
+			return
+		}
+	}
+	if err := validateInstance(inst); err != nil {
+		etcdErrorResponse(w, 400, etcdErrInvalidField, "Invalid field", err.Field+" "+err.Message, cluster.Index)
+		return
+	}
+	if !s.checkInstanceLimit(w, cluster, inst.URL) {
+		return
+	}
+
+	// members are authenticated with the cluster secret, so they don't get
+	// an instance secret
+	err := s.Backend.CreateInstance(inst)
+	countStorageError("CreateInstance", err)
+	if err == ErrExists {
+		instanceConflicts.inc()
+		etcdErrorResponse(w, 412, etcdErrNodeExist, "Key already exists", r.key, cluster.Index)
+		return
+	} else if err == ErrNotFound {
+		etcdNotFound(w, etcdKeyPath(cluster.ID), cluster.Index)
+		return
+	} else if err == ErrClusterFull {
+		etcdErrorResponse(w, 403, etcdErrRootROnly, "Cluster is full", "cluster is complete, no more members may join it", cluster.Index)
+		return
+	} else if err != nil {
+		etcdInternalError(w, err, cluster.Index)
+		return
+	}
+	instancesRegistered.inc()
+	etcdJSON(w, 201, inst.Index, &etcdResponse{Action: "create", Node: etcdInstanceNode(etcdKeyPath(cluster.ID), cluster.ID, inst)})
+}
+
+// EtcdDelete removes a member from a cluster. The client must be allowed to
+// modify the instance (see authorizeInstance).
+func (s *Server) EtcdDelete(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	r := s.etcdRequest(w, req, params, false)
+	if r == nil {
+		return
+	}
+	if len(r.path) == 0 || r.path[0] == "_config" {
+		etcdErrorResponse(w, 403, etcdErrRootROnly, "Root is read only", "only members can be removed", r.cluster.Index)
+		return
+	}
+	inst := s.etcdMember(w, r)
+	if inst == nil {
+		return
+	}
+	if msg := instanceAuthError(req, r.cluster, inst); msg != "" {
+		etcdErrorResponse(w, 401, etcdErrUnauthorized, "The request requires user authentication", msg, r.cluster.Index)
+		return
+	}
+	err := s.Backend.DeleteInstance(r.cluster.ID, inst.ID)
+	countStorageError("DeleteInstance", err)
+	if err == ErrNotFound {
+		etcdNotFound(w, r.key, r.cluster.Index)
+		return
+	} else if err != nil {
+		etcdInternalError(w, err, r.cluster.Index)
+		return
+	}
+	index := r.cluster.Index
+	cluster, err := s.Backend.GetCluster(r.cluster.ID)
+	countStorageError("GetCluster", err)
+	if err == nil {
+		index = cluster.Index
+	}
+	prev := etcdInstanceNode(etcdKeyPath(r.cluster.ID), r.cluster.ID, inst)
+	etcdJSON(w, 200, index, &etcdResponse{
+		Action:   "delete",
+		Node:     &etcdNode{Key: prev.Key, ModifiedIndex: index, CreatedIndex: prev.CreatedIndex},
+		PrevNode: prev,
+	})
+}
+
+// etcdRequest returns the cluster and key of an etcd API request if the
+// client may access the cluster (see authorizeCluster), otherwise it writes
+// an error response and returns nil.
+func (s *Server) etcdRequest(w http.ResponseWriter, req *http.Request, params httprouter.Params, write bool) *etcdRequest {
+	path := strings.Split(strings.Trim(params.ByName("key"), "/"), "/")
+	cluster, err := s.Backend.GetCluster(path[0])
+	countStorageError("GetCluster", err)
+	if err == ErrNotFound {
+		etcdNotFound(w, etcdKeyPath(path...), 0)
+		return nil
+	} else if err != nil {
+		etcdInternalError(w, err, 0)
+		return nil
+	}
+	if msg := clusterAuthError(req, cluster, write); msg != "" {
+		etcdErrorResponse(w, 401, etcdErrUnauthorized, "The request requires user authentication", msg, cluster.Index)
+		return nil
+	}
+	return &etcdRequest{
+		cluster: cluster,
+		path:    path[1:],
+		key:     etcdKeyPath(append([]string{cluster.ID}, path[1:]...)...),
+	}
+}
+
+// etcdMember returns the instance with the key of r, otherwise it writes an
+// error response and returns nil.
+func (s *Server) etcdMember(w http.ResponseWriter, r *etcdRequest) *discovery.Instance {
+	if len(r.path) != 1 {
+		etcdNotFound(w, r.key, r.cluster.Index)
+		return nil
+	}
+	instanceID, ok := etcdInstanceID(r.cluster.ID, r.path[0])
+	if !ok {
+		instanceID = r.path[0]
+	}
+	inst, err := s.Backend.GetInstance(r.cluster.ID, instanceID)
+	countStorageError("GetInstance", err)
+	if err == ErrNotFound {
+		etcdNotFound(w, r.key, r.cluster.Index)
+		return nil
+	} else if err != nil {
+		etcdInternalError(w, err, r.cluster.Index)
+		return nil
+	}
+	return inst
+}
+
+// parseEtcdMember parses the value of an etcd member, which lists its peer
+// URLs as "<name>=<peer_url>" separated by commas. If it is invalid the
+// returned message explains why.
+func parseEtcdMember(value string) (name string, urls []string, msg string) {
+	for _, member := range strings.Split(value, ",") {
+		i := strings.Index(member, "=")
+		if i < 0 {
+			return "", nil, "the value must be <name>=<peer_url>[,<name>=<peer_url>...]"
+		}
+		if len(urls) > 0 && member[:i] != name {
+			return "", nil, "all peer URLs must have the same member name"
+		}
+		name = member[:i]
+		urls = append(urls, member[i+1:])
+	}
+	return name, urls, ""
+}
+
+// etcdKeyPath returns the etcd key of path below the registry.
+func etcdKeyPath(path ...string) string {
+	return "/_etcd/registry/" + strings.Join(path, "/")
+}
+
+// etcdInstancePrefix returns the first half of the IDs of instances that are
+// registered as etcd members with the cluster, the second half is the member
+// ID.
+func etcdInstancePrefix(clusterID string) string {
+	sum := sha256.Sum256([]byte(clusterID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// etcdInstanceID returns the instance ID of the etcd member with the
+// hexadecimal memberID, and false if memberID is not a valid member ID.
+func etcdInstanceID(clusterID, memberID string) (string, bool) {
+	id, err := strconv.ParseUint(memberID, 16, 64)
+	if err != nil || strconv.FormatUint(id, 16) != memberID {
+		return "", false
+	}
+	return normalizeUUID(etcdInstancePrefix(clusterID) + fmt.Sprintf("%016x", id))
+}
+
+// etcdInstanceNode returns the etcd node of an instance in the directory dir,
+// whose key is the member ID if the instance was registered through the etcd
+// API and the instance ID otherwise.
+func etcdInstanceNode(dir, clusterID string, inst *discovery.Instance) *etcdNode {
+	key := inst.ID
+	id := strings.Replace(inst.ID, "-", "", -1)
+	if prefix := etcdInstancePrefix(clusterID); strings.HasPrefix(id, prefix) {
+		memberID, _ := strconv.ParseUint(id[len(prefix):], 16, 64)
+		key = strconv.FormatUint(memberID, 16)
+	}
+	urls := inst.PeerURLs
+	if len(urls) == 0 {
+		urls = []string{inst.URL}
+	}
+	members := make([]string, len(urls))
+	for i, u := range urls {
+		members[i] = inst.Name + "=" + u
+	}
+	node := &etcdNode{
+		Key:           dir + "/" + key,
+		Value:         strings.Join(members, ","),
+		Expiration:    inst.ExpiresAt,
+		ModifiedIndex: inst.Index,
+		CreatedIndex:  inst.CreatedIndex,
+	}
+	if inst.ExpiresAt != nil {
+		node.TTL = int64(inst.ExpiresAt.Sub(time.Now())/time.Second) + 1
+	}
+	return node
+}
+
+func etcdJSON(w http.ResponseWriter, status int, index int64, v interface{}) {
+	w.Header().Set("X-Etcd-Index", strconv.FormatInt(index, 10))
+	httphelper.JSON(w, status, v)
+}
+
+func etcdErrorResponse(w http.ResponseWriter, status, code int, message, cause string, index int64) {
+	etcdJSON(w, status, index, &etcdError{ErrorCode: code, Message: message, Cause: cause, Index: index})
+}
+
+func etcdNotFound(w http.ResponseWriter, key string, index int64) {
+	etcdErrorResponse(w, 404, etcdErrKeyNotFound, "Key not found", key, index)
+}
+
+func etcdInternalError(w http.ResponseWriter, err error, index int64) {
+	requestLogger(w).Error("etcd API error", "err", err)
+	etcdErrorResponse(w, 500, etcdErrRaftInternal, "Raft Internal Error", "", index)
+}
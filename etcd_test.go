@@ -0,0 +1,255 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEtcdTestToken creates a cluster of the given size through /new and
+// returns its ID.
+func newEtcdTestToken(t *testing.T, s *Server, size int) string {
+	res := testRequest(s, "GET", "/new?size="+strconv.Itoa(size), "", nil)
+	if res.Code != 200 {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	prefix := "http://discovery.test" + etcdRegistryPath
+	discoveryURL := strings.TrimSpace(res.Body.String())
+	if !strings.HasPrefix(discoveryURL, prefix) {
+		t.Fatalf("expected a discovery URL starting with %s, got %q", prefix, discoveryURL)
+	}
+	return strings.TrimPrefix(discoveryURL, prefix)
+}
+
+// etcdTestRequest serves an etcd API request for key with form as the
+// request body.
+func etcdTestRequest(s *Server, method, key string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, etcdRegistryPath+key, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	s.ServeHTTP(res, req)
+	return res
+}
+
+func etcdTestPut(s *Server, key, value string) *httptest.ResponseRecorder {
+	return etcdTestRequest(s, "PUT", key, url.Values{"value": {value}})
+}
+
+// expectEtcdError checks that res is an etcd error with the given status and
+// error code.
+func expectEtcdError(t *testing.T, res *httptest.ResponseRecorder, status, code int) {
+	if res.Code != status {
+		t.Errorf("expected status %d, got %d: %s", status, res.Code, res.Body)
+		return
+	}
+	var etcdErr etcdError
+	decodeTestResponse(t, res, &etcdErr)
+	if etcdErr.ErrorCode != code {
+		t.Errorf("expected error code %d, got %d: %s", code, etcdErr.ErrorCode, res.Body)
+	}
+}
+
+func TestEtcdNewToken(t *testing.T) {
+	s := NewServer("http://discovery.test", NewMemoryBackend())
+	for size, query := range map[string]string{"3": "", "5": "?size=5"} {
+		res := testRequest(s, "GET", "/new"+query, "", nil)
+		if res.Code != 200 {
+			t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+		}
+		token := strings.TrimPrefix(strings.TrimSpace(res.Body.String()), "http://discovery.test"+etcdRegistryPath)
+		res = etcdTestRequest(s, "GET", token+"/_config/size", nil)
+		var config etcdResponse
+		decodeTestResponse(t, res, &config)
+		if res.Code != 200 || config.Node == nil || config.Node.Value != size {
+			t.Errorf("expected size %s for /new%s, got %d: %s", size, query, res.Code, res.Body)
+		}
+	}
+	for _, size := range []string{"0", "-1", "three"} {
+		expectValidationError(t, testRequest(s, "GET", "/new?size="+size, "", nil), "size")
+	}
+}
+
+func TestEtcdMembers(t *testing.T) {
+	s := NewServer("http://discovery.test", NewMemoryBackend())
+	id := newEtcdTestToken(t, s, 3)
+
+	res := etcdTestPut(s, id+"/a1", "node1=http://10.0.0.1:2380")
+	if res.Code != 201 {
+		t.Fatalf("expected status 201, got %d: %s", res.Code, res.Body)
+	}
+	var created etcdResponse
+	decodeTestResponse(t, res, &created)
+	if created.Action != "create" || created.Node.Key != etcdKeyPath(id, "a1") || created.Node.Value != "node1=http://10.0.0.1:2380" {
+		t.Errorf("unexpected response %s", res.Body)
+	}
+	if created.Node.CreatedIndex != 1 || created.Node.ModifiedIndex != 1 || res.Header().Get("X-Etcd-Index") != "1" {
+		t.Errorf("expected index 1, got %s with X-Etcd-Index %s", res.Body, res.Header().Get("X-Etcd-Index"))
+	}
+
+	// members with several peer URLs repeat their name for each of them
+	value := "node2=http://10.0.0.2:2380,node2=http://[fd00::2]:2380"
+	res = etcdTestPut(s, id+"/b2", value)
+	if res.Code != 201 {
+		t.Fatalf("expected status 201, got %d: %s", res.Code, res.Body)
+	}
+	res = etcdTestRequest(s, "GET", id+"/b2", nil)
+	var member etcdResponse
+	decodeTestResponse(t, res, &member)
+	if res.Code != 200 || member.Action != "get" || member.Node.Value != value {
+		t.Errorf("expected member with value %q, got %d: %s", value, res.Code, res.Body)
+	}
+
+	for _, test := range []struct {
+		name   string
+		key    string
+		value  string
+		status int
+		code   int
+	}{
+		{"exists", "a1", "node1=http://10.0.0.1:2380", 412, etcdErrNodeExist},
+		{"no name", "c3", "http://10.0.0.3:2380", 400, etcdErrInvalidField},
+		{"different names", "c3", "node3=http://10.0.0.3:2380,node4=http://10.0.0.4:2380", 400, etcdErrInvalidField},
+		{"invalid URL", "c3", "node3=ftp://10.0.0.3", 400, etcdErrInvalidField},
+		{"invalid second URL", "c3", "node3=http://10.0.0.3:2380,node3=10.0.0.3", 400, etcdErrInvalidField},
+		{"invalid member ID", "node3", "node3=http://10.0.0.3:2380", 400, etcdErrInvalidField},
+		{"config", "_config/size", "5", 403, etcdErrRootROnly},
+		{"nested", "c3/d4", "node3=http://10.0.0.3:2380", 403, etcdErrRootROnly},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			expectEtcdError(t, etcdTestPut(s, id+"/"+test.key, test.value), test.status, test.code)
+		})
+	}
+
+	res = etcdTestRequest(s, "GET", id, nil)
+	var dir etcdResponse
+	decodeTestResponse(t, res, &dir)
+	if res.Code != 200 || !dir.Node.Dir || len(dir.Node.Nodes) != 3 {
+		t.Fatalf("expected a directory with the config and 2 members, got %d: %s", res.Code, res.Body)
+	}
+	if dir.Node.ModifiedIndex != 2 || res.Header().Get("X-Etcd-Index") != "2" {
+		t.Errorf("expected index 2, got %s with X-Etcd-Index %s", res.Body, res.Header().Get("X-Etcd-Index"))
+	}
+
+	// only the member or the cluster creator may remove a member
+	req := httptest.NewRequest("DELETE", etcdRegistryPath+id+"/a1", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	res = httptest.NewRecorder()
+	s.ServeHTTP(res, req)
+	expectEtcdError(t, res, 401, etcdErrUnauthorized)
+
+	res = etcdTestRequest(s, "DELETE", id+"/a1", nil)
+	var deleted etcdResponse
+	decodeTestResponse(t, res, &deleted)
+	if res.Code != 200 || deleted.Action != "delete" || deleted.PrevNode == nil || deleted.PrevNode.Value != "node1=http://10.0.0.1:2380" {
+		t.Fatalf("expected the member to be deleted, got %d: %s", res.Code, res.Body)
+	}
+	if deleted.Node.ModifiedIndex != 3 || deleted.Node.CreatedIndex != 1 {
+		t.Errorf("expected modified index 3 and created index 1, got %+v", deleted.Node)
+	}
+	expectEtcdError(t, etcdTestRequest(s, "GET", id+"/a1", nil), 404, etcdErrKeyNotFound)
+	expectEtcdError(t, etcdTestRequest(s, "DELETE", id+"/a1", nil), 404, etcdErrKeyNotFound)
+	expectEtcdError(t, etcdTestRequest(s, "DELETE", id+"/_config", nil), 403, etcdErrRootROnly)
+	expectEtcdError(t, etcdTestRequest(s, "GET", newUUID(), nil), 404, etcdErrKeyNotFound)
+}
+
+func TestEtcdCreatedIndex(t *testing.T) {
+	s := NewServer("http://discovery.test", NewMemoryBackend())
+	id := newEtcdTestToken(t, s, 3)
+	if res := etcdTestPut(s, id+"/a1", "node1=http://10.0.0.1:2380"); res.Code != 201 {
+		t.Fatalf("expected status 201, got %d: %s", res.Code, res.Body)
+	}
+	if res := etcdTestPut(s, id+"/b2", "node2=http://10.0.0.2:2380"); res.Code != 201 {
+		t.Fatalf("expected status 201, got %d: %s", res.Code, res.Body)
+	}
+
+	// renaming the member through the HTTP API modifies it at index 3
+	instanceID, _ := etcdInstanceID(id, "a1")
+	res := testRequest(s, "PATCH", "/clusters/"+id+"/instances/"+instanceID, "", map[string]interface{}{"data": map[string]string{"name": "renamed"}})
+	if res.Code != 200 {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	res = etcdTestRequest(s, "GET", id+"/a1", nil)
+	var member etcdResponse
+	decodeTestResponse(t, res, &member)
+	if member.Node.Value != "renamed=http://10.0.0.1:2380" {
+		t.Errorf("expected the renamed member, got %s", res.Body)
+	}
+	if member.Node.CreatedIndex != 1 || member.Node.ModifiedIndex != 3 {
+		t.Errorf("expected created index 1 and modified index 3, got %+v", member.Node)
+	}
+
+	res = etcdTestRequest(s, "GET", id+"?wait=true&waitIndex=3", nil)
+	var update etcdResponse
+	decodeTestResponse(t, res, &update)
+	if update.Action != "set" || update.Node.CreatedIndex != 1 || update.Node.ModifiedIndex != 3 {
+		t.Errorf("expected the update with created index 1 and modified index 3, got %s", res.Body)
+	}
+}
+
+func TestEtcdWait(t *testing.T) {
+	s := NewServer("http://discovery.test", NewMemoryBackend())
+	id := newEtcdTestToken(t, s, 3)
+
+	wait := func(query string) <-chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			done <- etcdTestRequest(s, "GET", id+"?wait=true"+query, nil)
+		}()
+		return done
+	}
+	expectEvent := func(done <-chan *httptest.ResponseRecorder, action string, index int64) *etcdResponse {
+		select {
+		case res := <-done:
+			var event etcdResponse
+			decodeTestResponse(t, res, &event)
+			if res.Code != 200 || event.Action != action || event.Node.ModifiedIndex != index {
+				t.Errorf("expected %s at index %d, got %d: %s", action, index, res.Code, res.Body)
+			}
+			if res.Header().Get("X-Etcd-Index") != strconv.FormatInt(index, 10) {
+				t.Errorf("expected X-Etcd-Index %d, got %s", index, res.Header().Get("X-Etcd-Index"))
+			}
+			return &event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", action)
+			return nil
+		}
+	}
+
+	// without a waitIndex the next change is returned
+	done := wait("")
+	select {
+	case res := <-done:
+		t.Fatalf("expected the request to wait for a change, got %d: %s", res.Code, res.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if res := etcdTestPut(s, id+"/a1", "node1=http://10.0.0.1:2380"); res.Code != 201 {
+		t.Fatalf("expected status 201, got %d: %s", res.Code, res.Body)
+	}
+	event := expectEvent(done, "create", 1)
+	if event.Node.Key != etcdKeyPath(id, "a1") || event.Node.CreatedIndex != 1 {
+		t.Errorf("expected member a1 created at index 1, got %+v", event.Node)
+	}
+
+	// past changes are returned immediately
+	if res := etcdTestPut(s, id+"/b2", "node2=http://10.0.0.2:2380"); res.Code != 201 {
+		t.Fatalf("expected status 201, got %d: %s", res.Code, res.Body)
+	}
+	expectEvent(wait("&waitIndex=1"), "create", 1)
+	expectEvent(wait("&waitIndex=2"), "create", 2)
+
+	done = wait("&waitIndex=3")
+	if res := etcdTestRequest(s, "DELETE", id+"/a1", nil); res.Code != 200 {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	event = expectEvent(done, "delete", 3)
+	if event.PrevNode == nil || event.PrevNode.Value != "node1=http://10.0.0.1:2380" || event.Node.CreatedIndex != 1 {
+		t.Errorf("expected the deleted member as the previous node, got %+v", event)
+	}
+
+	res := etcdTestRequest(s, "GET", id+"?wait=true&waitIndex=x", nil)
+	expectEtcdError(t, res, http.StatusBadRequest, etcdErrInvalidField)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+// instanceFormats are the formats instance lists can be exported in with the
+// format query parameter, besides the default JSON envelope.
+var instanceFormats = map[string]func(*discovery.Cluster, []*discovery.Instance) (string, []byte){
+	"prometheus":  prometheusTargets,
+	"hosts":       hostsFile,
+	"urls":        urlList,
+	"known_hosts": knownHosts,
+}
+
+// writeInstances writes instances in format, which must be a key of
+// instanceFormats.
+func writeInstances(w http.ResponseWriter, format string, cluster *discovery.Cluster, instances []*discovery.Instance) {
+	contentType, data := instanceFormats[format](cluster, instances)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+type prometheusTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// prometheusTargets returns a Prometheus file_sd target list with a target
+// group for each instance, whose target is the host and port of its URL.
+func prometheusTargets(cluster *discovery.Cluster, instances []*discovery.Instance) (string, []byte) {
+	groups := make([]*prometheusTargetGroup, 0, len(instances))
+	for _, inst := range instances {
+		host, port, ok := instanceHostPort(inst)
+		if !ok {
+			continue
+		}
+		labels := map[string]string{
+			"__meta_discovery_cluster_id":  cluster.ID,
+			"__meta_discovery_instance_id": inst.ID,
+			"__meta_discovery_url":         inst.URL,
+		}
+		if inst.Name != "" {
+			labels["__meta_discovery_name"] = inst.Name
+		}
+		if inst.FlynnVersion != "" {
+			labels["__meta_discovery_flynn_version"] = inst.FlynnVersion
+		}
+		groups = append(groups, &prometheusTargetGroup{
+			Targets: []string{net.JoinHostPort(host, strconv.Itoa(int(port)))},
+			Labels:  labels,
+		})
+	}
+	data, _ := json.Marshal(groups)
+	return "application/json", data
+}
+
+// hostsFile returns an /etc/hosts fragment mapping the name of each instance
+// to the IP address in its URL. Instances without a name or with a host name
+// in their URL are left out.
+func hostsFile(cluster *discovery.Cluster, instances []*discovery.Instance) (string, []byte) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# instances of cluster %s\n", cluster.ID)
+	for _, inst := range instances {
+		host, _, ok := instanceHostPort(inst)
+		if !ok || inst.Name == "" || net.ParseIP(host) == nil {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", host, inst.Name)
+	}
+	return "text/plain; charset=utf-8", buf.Bytes()
+}
+
+// urlList returns the URLs of the instances, one per line.
+func urlList(cluster *discovery.Cluster, instances []*discovery.Instance) (string, []byte) {
+	var buf bytes.Buffer
+	for _, inst := range instances {
+		if inst.URL != "" {
+			fmt.Fprintln(&buf, inst.URL)
+		}
+	}
+	return "text/plain; charset=utf-8", buf.Bytes()
+}
+
+// knownHosts returns an OpenSSH known_hosts file with the SSH public keys of
+// each instance for the host of its URL.
+func knownHosts(cluster *discovery.Cluster, instances []*discovery.Instance) (string, []byte) {
+	var buf bytes.Buffer
+	for _, inst := range instances {
+		host, _, ok := instanceHostPort(inst)
+		if !ok {
+			continue
+		}
+		for _, key := range inst.SSHPublicKeys {
+			fmt.Fprintf(&buf, "%s %s %s\n", host, key.Type, base64.StdEncoding.EncodeToString(key.Data))
+		}
+	}
+	return "text/plain; charset=utf-8", buf.Bytes()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+func TestInstanceFormats(t *testing.T) {
+	cluster := &discovery.Cluster{ID: "c1"}
+	key := testSSHKey(t)
+	instances := []*discovery.Instance{
+		{
+			ID:            "i1",
+			URL:           "http://10.0.0.1:1111",
+			Name:          "node1",
+			FlynnVersion:  "v20151104.1",
+			SSHPublicKeys: []discovery.SSHPublicKey{{Type: "ssh-ed25519", Data: key}},
+		},
+		// a host name and the default port of the scheme
+		{ID: "i2", URL: "https://node2.example.com"},
+		// no address
+		{ID: "i3", Name: "node3", SSHPublicKeys: []discovery.SSHPublicKey{{Type: "ssh-ed25519", Data: key}}},
+		{ID: "i4", URL: "ftp://10.0.0.4", Name: "node4"},
+		// no SSH key
+		{ID: "i5", URL: "http://[fd00::5]:1111", Name: "node5"},
+	}
+
+	for _, test := range []struct {
+		format      string
+		instances   []*discovery.Instance
+		contentType string
+		expected    string
+	}{
+		{
+			format:      "hosts",
+			instances:   instances,
+			contentType: "text/plain; charset=utf-8",
+			expected:    "# instances of cluster c1\n10.0.0.1\tnode1\nfd00::5\tnode5\n",
+		},
+		{
+			format:      "hosts",
+			contentType: "text/plain; charset=utf-8",
+			expected:    "# instances of cluster c1\n",
+		},
+		{
+			format:      "urls",
+			instances:   instances,
+			contentType: "text/plain; charset=utf-8",
+			expected:    "http://10.0.0.1:1111\nhttps://node2.example.com\nftp://10.0.0.4\nhttp://[fd00::5]:1111\n",
+		},
+		{
+			format:      "urls",
+			contentType: "text/plain; charset=utf-8",
+			expected:    "",
+		},
+		{
+			format:      "known_hosts",
+			instances:   instances,
+			contentType: "text/plain; charset=utf-8",
+			expected:    "10.0.0.1 ssh-ed25519 " + base64.StdEncoding.EncodeToString(key) + "\n",
+		},
+		{
+			format:      "known_hosts",
+			contentType: "text/plain; charset=utf-8",
+			expected:    "",
+		},
+		{
+			format:      "prometheus",
+			contentType: "application/json",
+			expected:    "[]",
+		},
+	} {
+		contentType, data := instanceFormats[test.format](cluster, test.instances)
+		if contentType != test.contentType {
+			t.Errorf("%s: expected content type %q, got %q", test.format, test.contentType, contentType)
+		}
+		if string(data) != test.expected {
+			t.Errorf("%s of %d instances: expected %q, got %q", test.format, len(test.instances), test.expected, data)
+		}
+	}
+
+	_, data := prometheusTargets(cluster, instances)
+	var groups []*prometheusTargetGroup
+	if err := json.Unmarshal(data, &groups); err != nil {
+		t.Fatal(err)
+	}
+	expected := []*prometheusTargetGroup{
+		{
+			Targets: []string{"10.0.0.1:1111"},
+			Labels: map[string]string{
+				"__meta_discovery_cluster_id":    "c1",
+				"__meta_discovery_instance_id":   "i1",
+				"__meta_discovery_url":           "http://10.0.0.1:1111",
+				"__meta_discovery_name":          "node1",
+				"__meta_discovery_flynn_version": "v20151104.1",
+			},
+		},
+		{
+			Targets: []string{"node2.example.com:443"},
+			Labels: map[string]string{
+				"__meta_discovery_cluster_id":  "c1",
+				"__meta_discovery_instance_id": "i2",
+				"__meta_discovery_url":         "https://node2.example.com",
+			},
+		},
+		{
+			Targets: []string{"[fd00::5]:1111"},
+			Labels: map[string]string{
+				"__meta_discovery_cluster_id":  "c1",
+				"__meta_discovery_instance_id": "i5",
+				"__meta_discovery_url":         "http://[fd00::5]:1111",
+				"__meta_discovery_name":        "node5",
+			},
+		},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("unexpected prometheus targets %s", data)
+	}
+}
+
+func TestGetInstancesFormat(t *testing.T) {
+	s, cluster := newTestServer(t)
+	createHTTPTestInstance(t, s, cluster, map[string]interface{}{"url": "http://10.0.0.1:1111", "name": "node1"})
+	path := "/clusters/" + cluster.ID + "/instances"
+
+	res := testRequest(s, "GET", path+"?format=hosts", "", nil)
+	if res.Code != 200 {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	if ct := res.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("expected a text/plain content type, got %q", ct)
+	}
+	if expected := "# instances of cluster " + cluster.ID + "\n10.0.0.1\tnode1\n"; res.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, res.Body)
+	}
+	if res.Header().Get("X-Discovery-Index") != "1" {
+		t.Errorf("expected X-Discovery-Index 1, got %q", res.Header().Get("X-Discovery-Index"))
+	}
+
+	res = testRequest(s, "GET", path+"?format=json", "", nil)
+	var list struct {
+		Data []*discovery.Instance `json:"data"`
+	}
+	decodeTestResponse(t, res, &list)
+	if res.Code != 200 || len(list.Data) != 1 {
+		t.Errorf("expected the JSON envelope with 1 instance, got %d: %s", res.Code, res.Body)
+	}
+
+	expectValidationError(t, testRequest(s, "GET", path+"?format=xml", "", nil), "format")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/flynn/flynn-discovery/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+// gcPolicy configures which clusters are considered abandoned and deleted by
+// the garbage collector.
+type gcPolicy struct {
+	// EmptyAfter is how long a cluster may exist without instances. Zero
+	// disables the condition.
+	EmptyAfter time.Duration
+
+	// InactiveAfter is how long a cluster may go without instances being
+	// added, changed, removed or sending heartbeats. Zero disables the
+	// condition.
+	InactiveAfter time.Duration
+
+	// BatchSize is the maximum number of clusters deleted at once.
+	BatchSize int
+
+	// DryRun reports abandoned clusters without deleting them.
+	DryRun bool
+}
+
+func (p gcPolicy) enabled() bool {
+	return p.EmptyAfter > 0 || p.InactiveAfter > 0
+}
+
+// gcStats counts the clusters deleted by the garbage collector since the
+// process started. It is updated atomically.
+var gcStats struct {
+	Runs             int64
+	Errors           int64
+	EmptyClusters    int64
+	InactiveClusters int64
+}
+
+// collectGarbage deletes abandoned clusters from backend every interval. It
+// never returns.
+func collectGarbage(backend StorageBackend, policy gcPolicy, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := runGC(backend, policy, func(cluster *discovery.Cluster, reason string) {
+			if policy.DryRun {
+				log.Info("gc: would delete cluster", "cluster_id", cluster.ID, "reason", reason, "created_at", cluster.CreatedAt.Format(time.RFC3339), "active_at", cluster.ActiveAt.Format(time.RFC3339))
+			}
+		})
+		if err != nil {
+			log.Error("error collecting abandoned clusters", "err", err)
+		}
+	}
+}
+
+// runGC deletes the clusters that are abandoned according to policy in
+// batches, and calls report with each of them and the reason it was deleted,
+// either "empty" or "inactive". In dry-run mode all abandoned clusters are
+// reported in a single batch.
+func runGC(backend StorageBackend, policy gcPolicy, report func(cluster *discovery.Cluster, reason string)) error {
+	atomic.AddInt64(&gcStats.Runs, 1)
+	now := time.Now()
+	var emptyBefore, inactiveBefore time.Time
+	if policy.EmptyAfter > 0 {
+		emptyBefore = now.Add(-policy.EmptyAfter)
+	}
+	if policy.InactiveAfter > 0 {
+		inactiveBefore = now.Add(-policy.InactiveAfter)
+	}
+	limit := policy.BatchSize
+	if policy.DryRun {
+		limit = 0
+	}
+
+	var empty, inactive int
+	for {
+		clusters, err := backend.DeleteAbandonedClusters(emptyBefore, inactiveBefore, limit, policy.DryRun)
+		countStorageError("DeleteAbandonedClusters", err)
+		if err != nil {
+			atomic.AddInt64(&gcStats.Errors, 1)
+			return err
+		}
+		for _, cluster := range clusters {
+			reason := "inactive"
+			if !emptyBefore.IsZero() && cluster.InstanceCount == 0 && cluster.CreatedAt.Before(emptyBefore) {
+				reason = "empty"
+				empty++
+			} else {
+				inactive++
+			}
+			report(cluster, reason)
+		}
+		if policy.DryRun || limit <= 0 || len(clusters) < limit {
+			break
+		}
+	}
+
+	if policy.DryRun {
+		if empty+inactive > 0 {
+			log.Info("gc: dry run found abandoned clusters", "empty", empty, "inactive", inactive)
+		}
+		return nil
+	}
+	atomic.AddInt64(&gcStats.EmptyClusters, int64(empty))
+	atomic.AddInt64(&gcStats.InactiveClusters, int64(inactive))
+	if empty+inactive > 0 {
+		log.Info("gc: deleted abandoned clusters", "empty", empty, "inactive", inactive)
+	}
+	return nil
+}
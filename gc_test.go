@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+// gcTestBackend records the limits DeleteAbandonedClusters is called with.
+type gcTestBackend struct {
+	StorageBackend
+	limits []int
+}
+
+func (b *gcTestBackend) DeleteAbandonedClusters(emptyBefore, inactiveBefore time.Time, limit int, dryRun bool) ([]*discovery.Cluster, error) {
+	b.limits = append(b.limits, limit)
+	return b.StorageBackend.DeleteAbandonedClusters(emptyBefore, inactiveBefore, limit, dryRun)
+}
+
+func TestRunGC(t *testing.T) {
+	resetMetrics()
+	defer resetMetrics()
+	b := &gcTestBackend{StorageBackend: NewMemoryBackend()}
+	var empty []string
+	for i := 0; i < 4; i++ {
+		empty = append(empty, createTestCluster(t, b).ID)
+	}
+	inactive := createTestCluster(t, b)
+	if err := b.CreateInstance(&discovery.Instance{ClusterID: inactive.ID, URL: "http://10.0.0.1:1111"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	policy := gcPolicy{EmptyAfter: time.Millisecond, InactiveAfter: time.Millisecond, BatchSize: 2}
+
+	// a dry run reports every abandoned cluster at once
+	reported := make(map[string]string)
+	report := func(cluster *discovery.Cluster, reason string) {
+		reported[cluster.ID] = reason
+	}
+	dryRun := policy
+	dryRun.DryRun = true
+	if err := runGC(b, dryRun, report); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.limits) != 1 || b.limits[0] != 0 {
+		t.Errorf("expected a single unlimited dry run, got limits %v", b.limits)
+	}
+	if len(reported) != 5 {
+		t.Errorf("expected 5 abandoned clusters, got %v", reported)
+	}
+	if gcStats.EmptyClusters != 0 || gcStats.InactiveClusters != 0 {
+		t.Errorf("expected a dry run not to count deleted clusters, got %+v", gcStats)
+	}
+	if _, err := b.GetCluster(inactive.ID); err != nil {
+		t.Errorf("expected a dry run not to delete clusters, got %v", err)
+	}
+
+	// clusters are deleted in batches until a batch is not full
+	b.limits = nil
+	reported = make(map[string]string)
+	if err := runGC(b, policy, report); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.limits) != 3 || b.limits[0] != 2 || b.limits[1] != 2 || b.limits[2] != 2 {
+		t.Errorf("expected 3 batches of 2 clusters, got limits %v", b.limits)
+	}
+	for _, id := range empty {
+		if reported[id] != "empty" {
+			t.Errorf("expected cluster %s to be deleted as empty, got %q", id, reported[id])
+		}
+	}
+	if reported[inactive.ID] != "inactive" {
+		t.Errorf("expected cluster %s to be deleted as inactive, got %q", inactive.ID, reported[inactive.ID])
+	}
+	if gcStats.Runs != 2 || gcStats.EmptyClusters != 4 || gcStats.InactiveClusters != 1 || gcStats.Errors != 0 {
+		t.Errorf("unexpected stats %+v", gcStats)
+	}
+	if _, err := b.GetCluster(inactive.ID); err != ErrNotFound {
+		t.Errorf("expected the cluster to be deleted, got %v", err)
+	}
+}
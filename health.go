@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+)
+
+type healthStatus struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Healthz reports that the process is alive and serving requests.
+func (s *Server) Healthz(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	httphelper.JSON(w, 200, healthStatus{Status: "ok"})
+}
+
+// Readyz reports whether the server should receive traffic, which is not the
+// case while it is draining or if the storage backend is unavailable.
+func (s *Server) Readyz(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if s.Draining() {
+		httphelper.JSON(w, 503, healthStatus{Status: "unavailable", Reason: "draining"})
+		return
+	}
+	if hc, ok := s.Backend.(HealthChecker); ok {
+		err := hc.CheckHealth(s.HealthTimeout)
+		countStorageError("CheckHealth", err)
+		if err != nil {
+			// the error may contain database addresses, so it is only logged
+			requestLogger(w).Error("storage health check failed", "err", err)
+			httphelper.JSON(w, 503, healthStatus{Status: "unavailable", Reason: "storage unavailable"})
+			return
+		}
+	}
+	httphelper.JSON(w, 200, healthStatus{Status: "ok"})
+}
+
+// Drain marks the server as not ready so that it is taken out of load
+// balancing before it shuts down. Requests are still served.
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// Draining returns whether Drain has been called.
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
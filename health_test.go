@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type unhealthyBackend struct {
+	StorageBackend
+}
+
+func (unhealthyBackend) CheckHealth(time.Duration) error {
+	return errors.New("dial tcp 10.1.2.3:5432: connection refused")
+}
+
+func TestReadyz(t *testing.T) {
+	s := NewServer("", NewMemoryBackend())
+	if res := testRequest(s, "GET", "/readyz", "", nil); res.Code != 200 {
+		t.Errorf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+
+	s = NewServer("", unhealthyBackend{NewMemoryBackend()})
+	res := testRequest(s, "GET", "/readyz", "", nil)
+	if res.Code != 503 {
+		t.Errorf("expected status 503, got %d: %s", res.Code, res.Body)
+	}
+	if strings.Contains(res.Body.String(), "10.1.2.3") {
+		t.Errorf("expected the storage error not to be disclosed, got %s", res.Body)
+	}
+
+	s = NewServer("", NewMemoryBackend())
+	s.Drain()
+	if res := testRequest(s, "GET", "/readyz", "", nil); res.Code != 503 {
+		t.Errorf("expected status 503 while draining, got %d: %s", res.Code, res.Body)
+	}
+}
@@ -1,101 +1,709 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+	"github.com/flynn/flynn-discovery/discovery"
 )
 
 type Server struct {
 	URL     string
 	Backend StorageBackend
-	router  *httprouter.Router
+
+	// WaitTimeout is the maximum time a long-polling request for cluster
+	// instances is held open.
+	WaitTimeout time.Duration
+
+	// HealthTimeout is the maximum time the readiness check waits for the
+	// storage backend.
+	HealthTimeout time.Duration
+
+	// RateLimiter enforces ClusterLimit and InstanceLimit per source IP.
+	RateLimiter   RateLimiter
+	ClusterLimit  RateLimit
+	InstanceLimit RateLimit
+
+	// MaxClusterInstances is the maximum number of live instances in a
+	// cluster, zero means unlimited.
+	MaxClusterInstances int
+
+	// TrustedProxies are the networks of proxies whose forwarding headers
+	// are used to determine the client IP. ForwardedHeader selects the
+	// header, X-Forwarded-For ("xff", the default) or Forwarded
+	// ("forwarded").
+	TrustedProxies  []*net.IPNet
+	ForwardedHeader string
+
+	draining int32 // accessed atomically
+	router   *httprouter.Router
+	handler  http.Handler
 }
 
 func NewServer(url string, backend StorageBackend) *Server {
 	s := &Server{
-		URL:     url,
-		Backend: backend,
-		router:  httprouter.New(),
+		URL:           url,
+		Backend:       backend,
+		WaitTimeout:   time.Minute,
+		HealthTimeout: 5 * time.Second,
+		RateLimiter:   NewMemoryRateLimiter(),
+		router:        httprouter.New(),
 	}
-	s.router.POST("/clusters", s.CreateCluster)
-	s.router.POST("/clusters/:cluster_id/instances", s.CreateInstance)
-	s.router.GET("/clusters/:cluster_id/instances", s.GetInstances)
+	s.router.POST("/clusters", instrument("CreateCluster", s.CreateCluster))
+	s.router.GET("/clusters/:cluster_id", instrument("GetCluster", s.GetCluster))
+	s.router.POST("/clusters/:cluster_id/secret", instrument("ResetClusterSecret", s.ResetClusterSecret))
+	s.router.POST("/clusters/:cluster_id/instances", instrument("CreateInstance", s.CreateInstance))
+	s.router.GET("/clusters/:cluster_id/instances", instrument("GetInstances", s.GetInstances))
+	s.router.GET("/clusters/:cluster_id/events", instrument("StreamEvents", s.StreamEvents))
+	s.router.GET("/clusters/:cluster_id/instances/:instance_id", instrument("GetInstance", s.GetInstance))
+	s.router.PATCH("/clusters/:cluster_id/instances/:instance_id", instrument("UpdateInstance", s.UpdateInstance))
+	s.router.DELETE("/clusters/:cluster_id/instances/:instance_id", instrument("DeleteInstance", s.DeleteInstance))
+	s.router.PUT("/clusters/:cluster_id/instances/:instance_id/heartbeat", instrument("HeartbeatInstance", s.HeartbeatInstance))
+	s.router.GET("/metrics", instrument("Metrics", s.Metrics))
+	s.router.GET("/healthz", instrument("Healthz", s.Healthz))
+	s.router.GET("/readyz", instrument("Readyz", s.Readyz))
+	s.router.GET("/v1/catalog/service/:cluster_id", instrument("ConsulCatalogService", s.ConsulCatalogService))
+	s.router.GET("/v1/health/service/:cluster_id", instrument("ConsulHealthService", s.ConsulHealthService))
+	s.router.GET("/new", instrument("NewEtcdToken", s.NewEtcdToken))
+	s.router.GET(etcdRegistryPath+"*key", instrument("EtcdGet", s.EtcdGet))
+	s.router.PUT(etcdRegistryPath+"*key", instrument("EtcdPut", s.EtcdPut))
+	s.router.DELETE(etcdRegistryPath+"*key", instrument("EtcdDelete", s.EtcdDelete))
+	s.handler = logRequests(s.router)
 
 	return s
 }
 
 func (s *Server) CreateCluster(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	cluster := &Cluster{
+	if !s.takeRateLimit(w, req, "clusters", s.ClusterLimit) {
+		return
+	}
+
+	// the request body is optional
+	var data struct {
+		Data *discovery.Cluster `json:"data"`
+	}
+	if err := httphelper.DecodeJSON(req, &data); err != nil && err != io.EOF {
+		httphelper.Error(w, err)
+		return
+	}
+
+	cluster := &discovery.Cluster{
 		CreatorIP:        sourceIP(req),
 		CreatorUserAgent: req.Header.Get("User-Agent"),
 	}
+	if data.Data != nil {
+		cluster.Size = data.Data.Size
+		cluster.Private = data.Data.Private
+	}
+	if cluster.Size < 0 {
+		httphelper.ValidationError(w, "size", "must not be negative")
+		return
+	}
 
 	if len(cluster.CreatorUserAgent) > 1000 {
 		cluster.CreatorUserAgent = cluster.CreatorUserAgent[:1000]
 	}
 
-	if err := s.Backend.CreateCluster(cluster); err != nil {
+	cluster.Secret, cluster.SecretHash = newSecret()
+
+	err := s.Backend.CreateCluster(cluster)
+	countStorageError("CreateCluster", err)
+	if err != nil {
 		httphelper.Error(w, err)
 		return
 	}
+	clustersCreated.inc()
 
 	w.Header().Set("Location", fmt.Sprintf("%s/clusters/%s", s.URL, cluster.ID))
-	w.WriteHeader(http.StatusCreated)
+	httphelper.JSON(w, http.StatusCreated, struct {
+		Data *discovery.Cluster `json:"data"`
+	}{cluster})
+}
+
+func (s *Server) GetCluster(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	cluster := s.getCluster(w, req, params.ByName("cluster_id"), false)
+	if cluster == nil {
+		return
+	}
+	httphelper.JSON(w, 200, struct {
+		Data *discovery.Cluster `json:"data"`
+	}{cluster})
+}
+
+// ResetClusterSecret replaces the secret of a cluster with a new one and
+// returns it. Clusters that were created before secrets were introduced don't
+// have one, they get their first secret this way.
+func (s *Server) ResetClusterSecret(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	cluster := s.getCluster(w, req, params.ByName("cluster_id"), true)
+	if cluster == nil {
+		return
+	}
+	if cluster.SecretHash == "" && sourceIP(req) != cluster.CreatorIP {
+		unauthorized(w, "only the cluster creator may set the first cluster secret")
+		return
+	}
+
+	secret, hash := newSecret()
+	err := s.Backend.SetClusterSecret(cluster.ID, cluster.SecretHash, hash)
+	countStorageError("SetClusterSecret", err)
+	if err == ErrNotFound {
+		httphelper.ObjectNotFoundError(w, "cluster not found")
+		return
+	} else if err == ErrConflict {
+		httphelper.Error(w, httphelper.JSONError{
+			Code:    httphelper.ConflictErrorCode,
+			Message: "the cluster secret was changed concurrently",
+		})
+		return
+	} else if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	cluster.Secret, cluster.SecretHash = secret, hash
+	httphelper.JSON(w, 200, struct {
+		Data *discovery.Cluster `json:"data"`
+	}{cluster})
+}
+
+// getCluster returns the cluster with the given ID if the client making req
+// may access it (see authorizeCluster), otherwise it writes an error response
+// and returns nil.
+func (s *Server) getCluster(w http.ResponseWriter, req *http.Request, clusterID string, write bool) *discovery.Cluster {
+	cluster, err := s.Backend.GetCluster(clusterID)
+	countStorageError("GetCluster", err)
+	if err == ErrNotFound {
+		httphelper.ObjectNotFoundError(w, "cluster not found")
+		return nil
+	} else if err != nil {
+		httphelper.Error(w, err)
+		return nil
+	}
+	if !authorizeCluster(w, req, cluster, write) {
+		return nil
+	}
+	return cluster
 }
 
 func (s *Server) CreateInstance(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if !s.takeRateLimit(w, req, "instances", s.InstanceLimit) {
+		return
+	}
+
 	var data struct {
-		Data *Instance `json:"data"`
+		Data json.RawMessage `json:"data"`
 	}
 	if err := httphelper.DecodeJSON(req, &data); err != nil {
 		httphelper.Error(w, err)
 		return
 	}
-	inst := data.Data
+	cluster := s.getCluster(w, req, params.ByName("cluster_id"), true)
+	if cluster == nil {
+		return
+	}
+	if len(data.Data) == 0 {
+		httphelper.ValidationError(w, "data", "is required")
+		return
+	}
+	if err := validateInstanceJSON(data.Data, false); err != nil {
+		httphelper.ValidationError(w, err.Field, err.Message)
+		return
+	}
+	inst := &discovery.Instance{}
+	if err := json.Unmarshal(data.Data, inst); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	setSSHFingerprints(inst.SSHPublicKeys)
+	if !s.checkInstanceLimit(w, cluster, inst.URL) {
+		return
+	}
+	// instance IDs are always generated by the backend
+	inst.ID = ""
 	inst.ClusterID = params.ByName("cluster_id")
 	inst.CreatorIP = sourceIP(req)
-	// TODO: validate with JSON schema
+	inst.Secret, inst.SecretHash = newSecret()
 
-	status := http.StatusCreated
-	if err := s.Backend.CreateInstance(inst); err == ErrExists {
-		status = http.StatusConflict
+	err := s.Backend.CreateInstance(inst)
+	countStorageError("CreateInstance", err)
+	if err == ErrExists {
+		instanceConflicts.inc()
+		// don't disclose the existing instance, only its registrant may
+		// access it with the instance secret
+		httphelper.ObjectExistsError(w, "an instance with this URL is already registered")
+		return
+	} else if err == ErrNotFound {
+		httphelper.ObjectNotFoundError(w, "cluster not found")
+		return
+	} else if err == ErrClusterFull {
+		httphelper.Error(w, httphelper.JSONError{
+			Code:    httphelper.ConflictErrorCode,
+			Message: "cluster is complete, no more instances may join it",
+		})
+		return
 	} else if err != nil {
 		httphelper.Error(w, err)
 		return
 	}
 
+	instancesRegistered.inc()
 	w.Header().Set("Location", fmt.Sprintf("%s/clusters/%s/instances/%s", s.URL, inst.ClusterID, inst.ID))
-	httphelper.JSON(w, status, data)
+	w.Header().Set("ETag", instanceETag(inst))
+	httphelper.JSON(w, http.StatusCreated, struct {
+		Data *discovery.Instance `json:"data"`
+	}{inst})
 }
 
+// GetInstances lists the instances of a cluster. The cluster's modification
+// index is returned in the X-Discovery-Index header. If the wait query
+// parameter is true, the request blocks until the index is greater than the
+// index query parameter (or the current index if it is not given), or until
+// the timeout query parameter or s.WaitTimeout, whichever is shorter, elapses.
+// The fingerprint query parameter only lists the
+// instances with an SSH public key of that SHA256 fingerprint, and the format
+// query parameter selects one of instanceFormats instead of the JSON envelope.
 func (s *Server) GetInstances(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	instances, err := s.Backend.GetClusterInstances(params.ByName("cluster_id"))
+	clusterID := params.ByName("cluster_id")
+	cluster := s.getCluster(w, req, clusterID, false)
+	if cluster == nil {
+		return
+	}
+	format := req.URL.Query().Get("format")
+	if _, ok := instanceFormats[format]; !ok && format != "" && format != "json" {
+		httphelper.ValidationError(w, "format", "must be one of json, prometheus, hosts, urls or known_hosts")
+		return
+	}
+
+	var err error
+	index := cluster.Index
+	if q := req.URL.Query(); q.Get("wait") == "true" {
+		wait := index
+		if q.Get("index") != "" {
+			wait, err = strconv.ParseInt(q.Get("index"), 10, 64)
+			if err != nil {
+				httphelper.ValidationError(w, "index", "must be an integer")
+				return
+			}
+		}
+		timeout := s.WaitTimeout
+		if q.Get("timeout") != "" {
+			t, err := time.ParseDuration(q.Get("timeout"))
+			if err != nil || t < 0 {
+				httphelper.ValidationError(w, "timeout", "must be a duration")
+				return
+			}
+			if t < timeout {
+				timeout = t
+			}
+		}
+		if index <= wait {
+			index, err = s.waitForChange(w, clusterID, wait, timeout)
+			if err != nil {
+				httphelper.Error(w, err)
+				return
+			}
+		}
+	}
+
+	instances, err := s.Backend.GetClusterInstances(clusterID)
+	countStorageError("GetClusterInstances", err)
 	if err != nil {
 		httphelper.Error(w, err)
 		return
 	}
+	// completeness is a property of the cluster, not of the filtered list
+	complete := isComplete(cluster.Size, len(instances))
+	if fingerprint := req.URL.Query().Get("fingerprint"); fingerprint != "" {
+		instances = instancesWithSSHKey(instances, fingerprint)
+	}
 	if instances == nil {
-		instances = []*Instance{}
+		instances = []*discovery.Instance{}
+	}
+	w.Header().Set("X-Discovery-Index", strconv.FormatInt(index, 10))
+	if _, ok := instanceFormats[format]; ok {
+		writeInstances(w, format, cluster, instances)
+		return
+	}
+	httphelper.JSON(w, 200, struct {
+		Data     []*discovery.Instance `json:"data"`
+		Size     int                   `json:"size,omitempty"`
+		Complete bool                  `json:"complete"`
+	}{instances, cluster.Size, complete})
+}
+
+// instancesWithSSHKey returns the instances with an SSH public key whose
+// fingerprint is fingerprint.
+func instancesWithSSHKey(instances []*discovery.Instance, fingerprint string) []*discovery.Instance {
+	var matches []*discovery.Instance
+	for _, inst := range instances {
+		for _, key := range inst.SSHPublicKeys {
+			if key.Fingerprint == fingerprint {
+				matches = append(matches, inst)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// waitForChange blocks until the modification index of the cluster is greater
+// than index, timeout elapses or the client goes away, and returns the latest
+// known index.
+func (s *Server) waitForChange(w http.ResponseWriter, clusterID string, index int64, timeout time.Duration) (int64, error) {
+	updates, stop := s.Backend.SubscribeCluster(clusterID)
+	defer stop()
+
+	// the cluster may have changed before the subscription was set up
+	cluster, err := s.Backend.GetCluster(clusterID)
+	countStorageError("GetCluster", err)
+	if err != nil {
+		return 0, err
+	}
+	current := cluster.Index
+	if current > index {
+		return current, nil
+	}
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	timer := time.After(timeout)
+	for {
+		select {
+		case current = <-updates:
+			if current > index {
+				return current, nil
+			}
+		case <-timer:
+			return current, nil
+		case <-closed:
+			return current, nil
+		}
+	}
+}
+
+// StreamEvents streams the membership events of a cluster as Server-Sent
+// Events. The ID of each event is the cluster's modification index, so a
+// client that reconnects with a Last-Event-ID header receives every event it
+// missed. Without the header only new events are streamed.
+func (s *Server) StreamEvents(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	clusterID := params.ByName("cluster_id")
+	updates, stop := s.Backend.SubscribeCluster(clusterID)
+	defer stop()
+
+	cluster := s.getCluster(w, req, clusterID, false)
+	if cluster == nil {
+		return
+	}
+	lastID := cluster.Index
+	var err error
+	if id := req.Header.Get("Last-Event-ID"); id != "" {
+		lastID, err = strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			httphelper.ValidationError(w, "Last-Event-ID", "must be an integer")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	out := httphelper.FlushWriter{Writer: w, Enabled: true}
+	// tell the client how long to wait before reconnecting
+	if _, err := fmt.Fprint(out, "retry: 1000\n\n"); err != nil {
+		return
+	}
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		events, err := s.Backend.GetEvents(clusterID, lastID)
+		countStorageError("GetEvents", err)
+		if err != nil {
+			requestLogger(w).Error("error getting cluster events", "err", err)
+			return
+		}
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(out, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+				return
+			}
+			lastID = event.ID
+		}
+
+		select {
+		case <-updates:
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(out, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (s *Server) GetInstance(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	cluster := s.getCluster(w, req, params.ByName("cluster_id"), false)
+	if cluster == nil {
+		return
+	}
+	inst, err := s.Backend.GetInstance(cluster.ID, params.ByName("instance_id"))
+	countStorageError("GetInstance", err)
+	if err == ErrNotFound {
+		httphelper.ObjectNotFoundError(w, "instance not found")
+		return
+	} else if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.Header().Set("ETag", instanceETag(inst))
+	httphelper.JSON(w, 200, struct {
+		Data *discovery.Instance `json:"data"`
+	}{inst})
+}
+
+// UpdateInstance changes the mutable fields of an instance. Its ETag is the
+// instance's modification index, if the request has an If-Match header the
+// instance is only updated if it hasn't been modified since. Only the fields
+// in the request are validated, requests that include immutable fields are
+// rejected.
+func (s *Server) UpdateInstance(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	var data struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := httphelper.DecodeJSON(req, &data); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	inst := s.getInstanceForWrite(w, req, params)
+	if inst == nil {
+		return
+	}
+	if len(data.Data) == 0 {
+		httphelper.ValidationError(w, "data", "is required")
+		return
+	}
+	// only the fields in the request are validated, so that instances
+	// registered before a rule was introduced can still be updated
+	if err := validateInstanceJSON(data.Data, true); err != nil {
+		httphelper.ValidationError(w, err.Field, err.Message)
+		return
+	}
+	update := &InstanceUpdate{}
+	if err := json.Unmarshal(data.Data, update); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	var index int64
+	if match := req.Header.Get("If-Match"); match != "" {
+		if !etagMatches(match, instanceETag(inst)) {
+			httphelper.Error(w, httphelper.PreconditionFailedErr("the instance has been modified"))
+			return
+		}
+		index = inst.Index
+	}
+
+	if update.SSHPublicKeys != nil {
+		setSSHFingerprints(*update.SSHPublicKeys)
+	}
+
+	inst, err := s.Backend.UpdateInstance(inst.ClusterID, inst.ID, update, index)
+	countStorageError("UpdateInstance", err)
+	if err == ErrNotFound {
+		httphelper.ObjectNotFoundError(w, "instance not found")
+		return
+	} else if err == ErrConflict {
+		httphelper.Error(w, httphelper.PreconditionFailedErr("the instance has been modified"))
+		return
+	} else if err != nil {
+		httphelper.Error(w, err)
+		return
 	}
+	w.Header().Set("ETag", instanceETag(inst))
 	httphelper.JSON(w, 200, struct {
-		Data []*Instance `json:"data"`
-	}{instances})
+		Data *discovery.Instance `json:"data"`
+	}{inst})
+}
+
+func (s *Server) DeleteInstance(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	inst := s.getInstanceForWrite(w, req, params)
+	if inst == nil {
+		return
+	}
+	err := s.Backend.DeleteInstance(inst.ClusterID, inst.ID)
+	countStorageError("DeleteInstance", err)
+	if err == ErrNotFound {
+		httphelper.ObjectNotFoundError(w, "instance not found")
+		return
+	} else if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) HeartbeatInstance(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	inst := s.getInstanceForWrite(w, req, params)
+	if inst == nil {
+		return
+	}
+	inst, err := s.Backend.HeartbeatInstance(inst.ClusterID, inst.ID)
+	countStorageError("HeartbeatInstance", err)
+	if err == ErrNotFound {
+		httphelper.ObjectNotFoundError(w, "instance not found")
+		return
+	} else if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, struct {
+		Data *discovery.Instance `json:"data"`
+	}{inst})
+}
+
+// getInstanceForWrite returns the instance identified by the request
+// parameters if the client making req may modify it (see authorizeInstance),
+// otherwise it writes an error response and returns nil.
+func (s *Server) getInstanceForWrite(w http.ResponseWriter, req *http.Request, params httprouter.Params) *discovery.Instance {
+	cluster, err := s.Backend.GetCluster(params.ByName("cluster_id"))
+	countStorageError("GetCluster", err)
+	if err == ErrNotFound {
+		httphelper.ObjectNotFoundError(w, "cluster not found")
+		return nil
+	} else if err != nil {
+		httphelper.Error(w, err)
+		return nil
+	}
+	inst, err := s.Backend.GetInstance(cluster.ID, params.ByName("instance_id"))
+	countStorageError("GetInstance", err)
+	if err == ErrNotFound {
+		// only tell members of private clusters which instances don't exist
+		if authorizeCluster(w, req, cluster, false) {
+			httphelper.ObjectNotFoundError(w, "instance not found")
+		}
+		return nil
+	} else if err != nil {
+		httphelper.Error(w, err)
+		return nil
+	}
+	if !authorizeInstance(w, req, cluster, inst) {
+		return nil
+	}
+	return inst
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.router.ServeHTTP(w, r)
+	// resolve the client IP once so that handlers only need to look at
+	// RemoteAddr, the port of a forwarded client is unknown
+	if len(s.TrustedProxies) > 0 {
+		if ip := clientIP(r, s.TrustedProxies, s.ForwardedHeader); ip != nil {
+			r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+		}
+	}
+	s.handler.ServeHTTP(w, r)
 }
 
-func sourceIP(req *http.Request) string {
-	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		return strings.TrimSpace(ips[len(ips)-1])
+func instanceETag(inst *discovery.Instance) string {
+	return fmt.Sprintf(`"%d"`, inst.Index)
+}
+
+// etagMatches reports whether the If-Match header value match matches etag.
+// Weak entity tags never match.
+func etagMatches(match, etag string) bool {
+	for _, tag := range strings.Split(match, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkInstanceLimit returns true if an instance with the given URL may be
+// registered with cluster without exceeding MaxClusterInstances, otherwise it
+// responds with 429 Too Many Requests and returns false.
+func (s *Server) checkInstanceLimit(w http.ResponseWriter, cluster *discovery.Cluster, url string) bool {
+	if s.MaxClusterInstances <= 0 || cluster.InstanceCount < s.MaxClusterInstances {
+		return true
+	}
+	// registering an instance again must still be rejected as a duplicate
+	// with 409 Conflict rather than 429, so only limit instances with new
+	// URLs
+	if exists, err := s.instanceURLExists(cluster.ID, url); err != nil {
+		httphelper.Error(w, err)
+		return false
+	} else if exists {
+		return true
 	}
+	// instances only leave the cluster when they are deleted or expire,
+	// which the reaper checks every minute
+	rateLimited(w, time.Minute, fmt.Sprintf("cluster has reached the maximum of %d instances", s.MaxClusterInstances))
+	return false
+}
+
+func (s *Server) instanceURLExists(clusterID, url string) (bool, error) {
+	instances, err := s.Backend.GetClusterInstances(clusterID)
+	countStorageError("GetClusterInstances", err)
+	if err != nil {
+		return false, err
+	}
+	for _, inst := range instances {
+		if inst.URL == url {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// takeRateLimit takes a token from the request's source IP bucket for action
+// and returns true, or responds with 429 Too Many Requests and returns false
+// if the bucket is empty. Requests are allowed if the rate limiter fails.
+func (s *Server) takeRateLimit(w http.ResponseWriter, req *http.Request, action string, limit RateLimit) bool {
+	if s.RateLimiter == nil || !limit.enabled() {
+		return true
+	}
+	wait, err := s.RateLimiter.Take(action+":"+sourceIP(req), limit)
+	if err != nil {
+		requestLogger(w).Error("error checking rate limit", "action", action, "err", err)
+		return true
+	}
+	if wait > 0 {
+		rateLimited(w, wait, "rate limit exceeded, try again later")
+		return false
+	}
+	return true
+}
+
+const rateLimitedErrorCode httphelper.ErrorCode = "rate_limited"
+
+func rateLimited(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	httphelper.JSON(w, http.StatusTooManyRequests, httphelper.JSONError{
+		Code:    rateLimitedErrorCode,
+		Message: message,
+	})
+}
+
+// sourceIP returns the IP of the client, which ServeHTTP resolves from trusted
+// proxies' forwarding headers.
+func sourceIP(req *http.Request) string {
 	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
 	return ip
 }
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+// newTestServer returns a server with a memory backend and a cluster created
+// through the API, so that its secret is set.
+func newTestServer(t *testing.T) (*Server, *discovery.Cluster) {
+	s := NewServer("http://discovery.test", NewMemoryBackend())
+	return s, createHTTPTestCluster(t, s, nil)
+}
+
+func createHTTPTestCluster(t *testing.T, s http.Handler, data *discovery.Cluster) *discovery.Cluster {
+	var body interface{}
+	if data != nil {
+		body = map[string]interface{}{"data": data}
+	}
+	res := testRequest(s, "POST", "/clusters", "", body)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("expected status 201 creating cluster, got %d: %s", res.Code, res.Body)
+	}
+	var cluster struct {
+		Data *discovery.Cluster `json:"data"`
+	}
+	decodeTestResponse(t, res, &cluster)
+	return cluster.Data
+}
+
+// createHTTPTestInstance registers an instance with the cluster through the
+// API and returns it with its secret.
+func createHTTPTestInstance(t *testing.T, s http.Handler, cluster *discovery.Cluster, data map[string]interface{}) *discovery.Instance {
+	res := testRequest(s, "POST", "/clusters/"+cluster.ID+"/instances", cluster.Secret, map[string]interface{}{"data": data})
+	if res.Code != http.StatusCreated {
+		t.Fatalf("expected status 201 registering instance, got %d: %s", res.Code, res.Body)
+	}
+	var inst struct {
+		Data *discovery.Instance `json:"data"`
+	}
+	decodeTestResponse(t, res, &inst)
+	return inst.Data
+}
+
+// testRequest serves a request with body encoded as JSON, unless it is nil or
+// already a string, and the secret as a bearer token if it is set.
+func testRequest(s http.Handler, method, path, secret string, body interface{}) *httptest.ResponseRecorder {
+	var r io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		r = bytes.NewBufferString(body)
+	default:
+		data, _ := json.Marshal(body)
+		r = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, r)
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	res := httptest.NewRecorder()
+	s.ServeHTTP(res, req)
+	return res
+}
+
+func decodeTestResponse(t *testing.T, res *httptest.ResponseRecorder, v interface{}) {
+	if err := json.Unmarshal(res.Body.Bytes(), v); err != nil {
+		t.Fatalf("error decoding response %q: %s", res.Body, err)
+	}
+}
+
+// expectValidationError checks that res is a validation error of field.
+func expectValidationError(t *testing.T, res *httptest.ResponseRecorder, field string) {
+	if res.Code != 400 {
+		t.Errorf("expected status 400, got %d: %s", res.Code, res.Body)
+		return
+	}
+	var jsonErr httphelper.JSONError
+	decodeTestResponse(t, res, &jsonErr)
+	if jsonErr.Code != httphelper.ValidationErrorCode {
+		t.Errorf("expected code %q, got %q", httphelper.ValidationErrorCode, jsonErr.Code)
+	}
+	var detail struct {
+		Field string `json:"field"`
+	}
+	json.Unmarshal(jsonErr.Detail, &detail)
+	if detail.Field != field {
+		t.Errorf("expected field %q, got %q (%s)", field, detail.Field, jsonErr.Message)
+	}
+}
+
+// expectError checks that res is an error response with the given status and
+// code.
+func expectError(t *testing.T, res *httptest.ResponseRecorder, status int, code httphelper.ErrorCode) {
+	if res.Code != status {
+		t.Errorf("expected status %d, got %d: %s", status, res.Code, res.Body)
+		return
+	}
+	var jsonErr httphelper.JSONError
+	decodeTestResponse(t, res, &jsonErr)
+	if jsonErr.Code != code {
+		t.Errorf("expected code %q, got %q", code, jsonErr.Code)
+	}
+}
+
+func TestClusterAuth(t *testing.T) {
+	s, cluster := newTestServer(t)
+	private := createHTTPTestCluster(t, s, &discovery.Cluster{Private: true})
+	instances := func(c *discovery.Cluster) string { return "/clusters/" + c.ID + "/instances" }
+	register := map[string]interface{}{"data": map[string]string{"url": "http://10.0.0.1:1111"}}
+
+	for _, test := range []struct {
+		name     string
+		method   string
+		path     string
+		secret   string
+		password string // sent with basic auth instead of a bearer token
+		status   int
+	}{
+		{name: "write without secret", method: "POST", path: instances(cluster), status: 401},
+		{name: "write with invalid secret", method: "POST", path: instances(cluster), secret: "invalid", status: 401},
+		{name: "write with other cluster's secret", method: "POST", path: instances(cluster), secret: private.Secret, status: 401},
+		{name: "write with invalid password", method: "POST", path: instances(cluster), password: "invalid", status: 401},
+		{name: "write with password", method: "POST", path: instances(cluster), password: cluster.Secret, status: 201},
+		{name: "read public cluster", method: "GET", path: instances(cluster), status: 200},
+		{name: "read private cluster without secret", method: "GET", path: instances(private), status: 401},
+		{name: "read private cluster with invalid secret", method: "GET", path: instances(private), secret: "invalid", status: 401},
+		{name: "read private cluster with secret", method: "GET", path: instances(private), secret: private.Secret, status: 200},
+		{name: "read private cluster with password", method: "GET", path: instances(private), password: private.Secret, status: 200},
+		{name: "get private cluster without secret", method: "GET", path: "/clusters/" + private.ID, status: 401},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var body interface{}
+			if test.method == "POST" {
+				body = register
+			}
+			data, _ := json.Marshal(body)
+			req := httptest.NewRequest(test.method, test.path, bytes.NewReader(data))
+			if test.secret != "" {
+				req.Header.Set("Authorization", "Bearer "+test.secret)
+			}
+			if test.password != "" {
+				req.SetBasicAuth("", test.password)
+			}
+			res := httptest.NewRecorder()
+			s.ServeHTTP(res, req)
+			if test.status == 401 {
+				expectError(t, res, 401, httphelper.UnauthorizedErrorCode)
+				if res.Header().Get("WWW-Authenticate") == "" {
+					t.Error("expected a WWW-Authenticate header")
+				}
+			} else if res.Code != test.status {
+				t.Errorf("expected status %d, got %d: %s", test.status, res.Code, res.Body)
+			}
+		})
+	}
+}
+
+func TestResetClusterSecret(t *testing.T) {
+	s, cluster := newTestServer(t)
+	path := "/clusters/" + cluster.ID + "/secret"
+
+	expectError(t, testRequest(s, "POST", path, "", nil), 401, httphelper.UnauthorizedErrorCode)
+
+	res := testRequest(s, "POST", path, cluster.Secret, nil)
+	if res.Code != 200 {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	var reset struct {
+		Data *discovery.Cluster `json:"data"`
+	}
+	decodeTestResponse(t, res, &reset)
+	if reset.Data.Secret == "" || reset.Data.Secret == cluster.Secret {
+		t.Fatalf("expected a new secret, got %q", reset.Data.Secret)
+	}
+
+	// the old secret no longer works
+	register := map[string]interface{}{"data": map[string]string{"url": "http://10.0.0.1:1111"}}
+	expectError(t, testRequest(s, "POST", "/clusters/"+cluster.ID+"/instances", cluster.Secret, register), 401, httphelper.UnauthorizedErrorCode)
+	expectError(t, testRequest(s, "POST", path, cluster.Secret, nil), 401, httphelper.UnauthorizedErrorCode)
+	if res := testRequest(s, "POST", "/clusters/"+cluster.ID+"/instances", reset.Data.Secret, register); res.Code != 201 {
+		t.Errorf("expected status 201 with the new secret, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func TestLegacyClusterAuth(t *testing.T) {
+	s := NewServer("http://discovery.test", NewMemoryBackend())
+	// clusters created before secrets were introduced have none
+	cluster := &discovery.Cluster{CreatorIP: "192.0.2.1"}
+	if err := s.Backend.CreateCluster(cluster); err != nil {
+		t.Fatal(err)
+	}
+	path := "/clusters/" + cluster.ID
+
+	res := testRequest(s, "POST", path+"/instances", "", map[string]interface{}{"data": map[string]string{"url": "http://10.0.0.1:1111"}})
+	if res.Code != 201 {
+		t.Fatalf("expected status 201 registering without a secret, got %d: %s", res.Code, res.Body)
+	}
+	if res := testRequest(s, "GET", path+"/instances", "", nil); res.Code != 200 {
+		t.Errorf("expected status 200 listing without a secret, got %d: %s", res.Code, res.Body)
+	}
+
+	// only the creator may set the first secret
+	req := httptest.NewRequest("POST", path+"/secret", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	res = httptest.NewRecorder()
+	s.ServeHTTP(res, req)
+	expectError(t, res, 401, httphelper.UnauthorizedErrorCode)
+
+	res = testRequest(s, "POST", path+"/secret", "", nil)
+	if res.Code != 200 {
+		t.Fatalf("expected status 200 setting the first secret, got %d: %s", res.Code, res.Body)
+	}
+	var reset struct {
+		Data *discovery.Cluster `json:"data"`
+	}
+	decodeTestResponse(t, res, &reset)
+	res = testRequest(s, "POST", path+"/instances", "", map[string]interface{}{"data": map[string]string{"url": "http://10.0.0.2:1111"}})
+	expectError(t, res, 401, httphelper.UnauthorizedErrorCode)
+	res = testRequest(s, "POST", path+"/instances", reset.Data.Secret, map[string]interface{}{"data": map[string]string{"url": "http://10.0.0.2:1111"}})
+	if res.Code != 201 {
+		t.Errorf("expected status 201 with the secret, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func TestInstanceAuth(t *testing.T) {
+	s, cluster := newTestServer(t)
+	inst := createHTTPTestInstance(t, s, cluster, map[string]interface{}{"url": "http://10.0.0.1:1111"})
+	if inst.Secret == "" {
+		t.Fatal("expected the instance secret to be returned")
+	}
+
+	// instances registered before instance secrets were introduced
+	legacy := &discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.2:1111", CreatorIP: "192.0.2.1"}
+	legacyCluster := &discovery.Cluster{CreatorIP: "192.0.2.2"}
+	if err := s.Backend.CreateInstance(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Backend.CreateCluster(legacyCluster); err != nil {
+		t.Fatal(err)
+	}
+	legacyInstance := &discovery.Instance{ClusterID: legacyCluster.ID, URL: "http://10.0.0.3:1111", CreatorIP: "192.0.2.3"}
+	if err := s.Backend.CreateInstance(legacyInstance); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		inst   *discovery.Instance
+		secret string
+		ip     string
+		status int
+	}{
+		{name: "instance secret", inst: inst, secret: inst.Secret, status: 200},
+		{name: "no secret", inst: inst, status: 401},
+		{name: "invalid secret", inst: inst, secret: "invalid", status: 401},
+		// the cluster secret only allows registering instances
+		{name: "cluster secret", inst: inst, secret: cluster.Secret, status: 401},
+		{name: "legacy instance with cluster secret", inst: legacy, secret: cluster.Secret, status: 200},
+		{name: "legacy instance without secret", inst: legacy, status: 401},
+		{name: "legacy instance from creator IP", inst: legacy, ip: "192.0.2.1", status: 401},
+		{name: "legacy cluster from instance creator IP", inst: legacyInstance, ip: "192.0.2.3", status: 200},
+		{name: "legacy cluster from cluster creator IP", inst: legacyInstance, ip: "192.0.2.2", status: 200},
+		{name: "legacy cluster from other IP", inst: legacyInstance, ip: "198.51.100.1", status: 401},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/clusters/"+test.inst.ClusterID+"/instances/"+test.inst.ID+"/heartbeat", nil)
+			if test.secret != "" {
+				req.Header.Set("Authorization", "Bearer "+test.secret)
+			}
+			if test.ip != "" {
+				req.RemoteAddr = test.ip + ":1234"
+			}
+			res := httptest.NewRecorder()
+			s.ServeHTTP(res, req)
+			if test.status == 401 {
+				expectError(t, res, 401, httphelper.UnauthorizedErrorCode)
+			} else if res.Code != test.status {
+				t.Errorf("expected status %d, got %d: %s", test.status, res.Code, res.Body)
+			}
+		})
+	}
+}
+
+func TestCreateInstanceExists(t *testing.T) {
+	s, cluster := newTestServer(t)
+	inst := createHTTPTestInstance(t, s, cluster, map[string]interface{}{"url": "http://10.0.0.1:1111"})
+
+	res := testRequest(s, "POST", "/clusters/"+cluster.ID+"/instances", cluster.Secret, map[string]interface{}{"data": map[string]string{"url": inst.URL}})
+	expectError(t, res, 409, httphelper.ObjectExistsErrorCode)
+	// only the registrant may learn the existing instance and its secret
+	for _, leak := range []string{inst.ID, inst.Secret} {
+		if strings.Contains(res.Body.String(), leak) {
+			t.Errorf("expected the response not to contain %q: %s", leak, res.Body)
+		}
+	}
+	if res.Header().Get("Location") != "" {
+		t.Errorf("expected no Location header, got %q", res.Header().Get("Location"))
+	}
+}
+
+func TestUpdateInstance(t *testing.T) {
+	s, cluster := newTestServer(t)
+	inst := createHTTPTestInstance(t, s, cluster, map[string]interface{}{"url": "http://10.0.0.1:1111"})
+	path := "/clusters/" + cluster.ID + "/instances/" + inst.ID
+	update := map[string]interface{}{"data": map[string]string{"name": "node1"}}
+
+	res := testRequest(s, "GET", path, "", nil)
+	etag := res.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf(`expected ETag "1", got %q`, etag)
+	}
+
+	patch := func(secret, match string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest("PATCH", path, bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		if match != "" {
+			req.Header.Set("If-Match", match)
+		}
+		res := httptest.NewRecorder()
+		s.ServeHTTP(res, req)
+		return res
+	}
+
+	res = patch(inst.Secret, etag, update)
+	if res.Code != 200 {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	if res.Header().Get("ETag") != `"2"` {
+		t.Errorf(`expected ETag "2", got %q`, res.Header().Get("ETag"))
+	}
+	var updated struct {
+		Data *discovery.Instance `json:"data"`
+	}
+	decodeTestResponse(t, res, &updated)
+	if updated.Data.Name != "node1" || updated.Data.URL != inst.URL || updated.Data.Index != 2 {
+		t.Errorf("unexpected instance %s", res.Body)
+	}
+
+	// the instance has been modified since the first ETag
+	expectError(t, patch(inst.Secret, etag, update), 412, httphelper.PreconditionFailedErrorCode)
+	if res := patch(inst.Secret, `"2", "3"`, update); res.Code != 200 {
+		t.Errorf("expected status 200 with a matching ETag, got %d: %s", res.Code, res.Body)
+	}
+	if res := patch(inst.Secret, "*", update); res.Code != 200 {
+		t.Errorf("expected status 200 with If-Match *, got %d: %s", res.Code, res.Body)
+	}
+
+	expectError(t, patch("invalid", "", update), 401, httphelper.UnauthorizedErrorCode)
+	expectError(t, patch(cluster.Secret, "", update), 401, httphelper.UnauthorizedErrorCode)
+
+	// immutable fields are rejected rather than ignored
+	expectValidationError(t, patch(inst.Secret, "", map[string]interface{}{"data": map[string]string{"url": "http://10.0.0.2:1111"}}), "url")
+	res = testRequest(s, "GET", path, "", nil)
+	var current struct {
+		Data *discovery.Instance `json:"data"`
+	}
+	decodeTestResponse(t, res, &current)
+	if current.Data.URL != inst.URL {
+		t.Errorf("expected the URL to be unchanged, got %q", current.Data.URL)
+	}
+}
+
+func TestGetInstancesWait(t *testing.T) {
+	s, cluster := newTestServer(t)
+	path := "/clusters/" + cluster.ID + "/instances?wait=true"
+
+	type result struct {
+		res     *httptest.ResponseRecorder
+		elapsed time.Duration
+	}
+	get := func(params string) <-chan result {
+		done := make(chan result, 1)
+		go func() {
+			start := time.Now()
+			res := testRequest(s, "GET", path+params, "", nil)
+			done <- result{res, time.Since(start)}
+		}()
+		return done
+	}
+	expectInstances := func(r result, index string, count int) {
+		if r.res.Code != 200 {
+			t.Fatalf("expected status 200, got %d: %s", r.res.Code, r.res.Body)
+		}
+		if r.res.Header().Get("X-Discovery-Index") != index {
+			t.Errorf("expected X-Discovery-Index %s, got %q", index, r.res.Header().Get("X-Discovery-Index"))
+		}
+		var list struct {
+			Data []*discovery.Instance `json:"data"`
+		}
+		decodeTestResponse(t, r.res, &list)
+		if len(list.Data) != count {
+			t.Errorf("expected %d instances, got %s", count, r.res.Body)
+		}
+	}
+
+	// the request returns the current list when the timeout elapses
+	r := <-get("&timeout=100ms")
+	expectInstances(r, "0", 0)
+	if r.elapsed < 100*time.Millisecond {
+		t.Errorf("expected the request to wait 100ms, returned after %s", r.elapsed)
+	}
+
+	// or as soon as the cluster changes
+	done := get("&index=0&timeout=5s")
+	select {
+	case r := <-done:
+		t.Fatalf("expected the request to block, got %d: %s", r.res.Code, r.res.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+	createHTTPTestInstance(t, s, cluster, map[string]interface{}{"url": "http://10.0.0.1:1111"})
+	select {
+	case r := <-done:
+		expectInstances(r, "1", 1)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the request to return")
+	}
+
+	// an index older than the current one returns immediately
+	select {
+	case r := <-get("&index=0"):
+		expectInstances(r, "1", 1)
+	case <-time.After(time.Second):
+		t.Fatal("expected index=0 to return immediately")
+	}
+
+	expectValidationError(t, testRequest(s, "GET", path+"&index=x", "", nil), "index")
+	expectValidationError(t, testRequest(s, "GET", path+"&timeout=x", "", nil), "timeout")
+}
+
+// readTestEvent reads the next Server-Sent Event, skipping comments and the
+// retry field.
+func readTestEvent(t *testing.T, r *bufio.Reader) (id, typ string, event *Event) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading event: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if event != nil {
+				return id, typ, event
+			}
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event = &Event{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), event); err != nil {
+				t.Fatalf("error decoding event %q: %s", line, err)
+			}
+		case line == "retry: 1000", strings.HasPrefix(line, ":"):
+		default:
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	s, cluster := newTestServer(t)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	first := createHTTPTestInstance(t, s, cluster, map[string]interface{}{"url": "http://10.0.0.1:1111"})
+
+	stream := func(lastEventID string) (*bufio.Reader, func()) {
+		req, _ := http.NewRequest("GET", srv.URL+"/clusters/"+cluster.ID+"/events", nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "text/event-stream; charset=utf-8" {
+			t.Errorf("unexpected content type %q", ct)
+		}
+		return bufio.NewReader(res.Body), func() { res.Body.Close() }
+	}
+
+	// without Last-Event-ID only new events are streamed
+	events, stop := stream("")
+	defer stop()
+	if line, _ := events.ReadString('\n'); line != "retry: 1000\n" {
+		t.Errorf("expected the retry field first, got %q", line)
+	}
+	second := createHTTPTestInstance(t, s, cluster, map[string]interface{}{"url": "http://10.0.0.2:1111"})
+	id, typ, event := readTestEvent(t, events)
+	if id != "2" || typ != string(EventInstanceCreated) || event.ID != 2 || event.Instance.ID != second.ID {
+		t.Errorf("unexpected event %s %s %+v", id, typ, event)
+	}
+	if res := testRequest(s, "DELETE", "/clusters/"+cluster.ID+"/instances/"+first.ID, first.Secret, nil); res.Code != 200 {
+		t.Fatalf("expected status 200 deleting instance, got %d: %s", res.Code, res.Body)
+	}
+	id, typ, event = readTestEvent(t, events)
+	if id != "3" || typ != string(EventInstanceDeleted) || event.Instance.ID != first.ID {
+		t.Errorf("unexpected event %s %s %+v", id, typ, event)
+	}
+	if event.Instance.Secret != "" || event.Instance.SecretHash != "" {
+		t.Errorf("expected the event not to contain the instance secret, got %+v", event.Instance)
+	}
+
+	// a reconnecting client receives the events it missed
+	resumed, stopResumed := stream("1")
+	defer stopResumed()
+	for _, expected := range []string{"2", "3"} {
+		if id, _, _ := readTestEvent(t, resumed); id != expected {
+			t.Errorf("expected event %s, got %s", expected, id)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/clusters/"+cluster.ID+"/events", nil)
+	req.Header.Set("Last-Event-ID", "x")
+	res := httptest.NewRecorder()
+	s.ServeHTTP(res, req)
+	expectValidationError(t, res, "Last-Event-ID")
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is a JSON Schema (draft 7) that supports the keywords used to
+// validate request payloads: type, required, properties, items, enum,
+// minLength, maxLength, pattern, format, maxItems and minimum. The
+// non-standard errorMessage keyword replaces the message of enum, pattern and
+// format violations.
+type jsonSchema struct {
+	Type         jsonSchemaTypes        `json:"type"`
+	Required     []string               `json:"required"`
+	Properties   map[string]*jsonSchema `json:"properties"`
+	Items        *jsonSchema            `json:"items"`
+	Enum         []interface{}          `json:"enum"`
+	MinLength    *int                   `json:"minLength"`
+	MaxLength    *int                   `json:"maxLength"`
+	Pattern      string                 `json:"pattern"`
+	Format       string                 `json:"format"`
+	MaxItems     *int                   `json:"maxItems"`
+	Minimum      *float64               `json:"minimum"`
+	ErrorMessage string                 `json:"errorMessage"`
+
+	pattern *regexp.Regexp
+}
+
+// jsonSchemaTypes is the type keyword, which is either a type name or a list
+// of type names.
+type jsonSchemaTypes []string
+
+func (t *jsonSchemaTypes) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = jsonSchemaTypes{name}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+// jsonSchemaFormat checks a value whose schema has a format. path is the
+// field name of the value, the returned error may name a field below it.
+type jsonSchemaFormat func(path string, v interface{}) *validationError
+
+// mustParseJSONSchema parses a schema whose formats are defined in formats,
+// and panics if it is invalid.
+func mustParseJSONSchema(data string, formats map[string]jsonSchemaFormat) *jsonSchema {
+	schema := &jsonSchema{}
+	if err := json.Unmarshal([]byte(data), schema); err != nil {
+		panic(fmt.Sprintf("invalid JSON schema: %s", err))
+	}
+	if err := schema.compile(formats); err != nil {
+		panic(fmt.Sprintf("invalid JSON schema: %s", err))
+	}
+	return schema
+}
+
+func (s *jsonSchema) compile(formats map[string]jsonSchemaFormat) error {
+	if s.Pattern != "" {
+		var err error
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return err
+		}
+	}
+	if _, ok := formats[s.Format]; s.Format != "" && !ok {
+		return fmt.Errorf("unknown format %q", s.Format)
+	}
+	for _, prop := range s.Properties {
+		if err := prop.compile(formats); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(formats)
+	}
+	return nil
+}
+
+// validate checks v, a value decoded by encoding/json, against the schema
+// and returns the first violation, or nil if v is valid. path is the field
+// name of v. Properties are checked in alphabetical order after the required
+// ones are known to be present. If partial is true required properties may
+// be missing, which validates updates that only contain changed fields.
+func (s *jsonSchema) validate(path string, v interface{}, formats map[string]jsonSchemaFormat, partial bool) *validationError {
+	if !s.hasType(v) {
+		return &validationError{path, "must be " + s.typeDescription()}
+	}
+	if len(s.Enum) > 0 && !s.inEnum(v) {
+		return s.violation(path, fmt.Sprintf("must be one of %s", s.enumDescription()))
+	}
+
+	switch v := v.(type) {
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			if length == 0 {
+				return &validationError{path, "must not be empty"}
+			}
+			return &validationError{path, fmt.Sprintf("must be at least %d characters", *s.MinLength)}
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return &validationError{path, fmt.Sprintf("must be at most %d characters", *s.MaxLength)}
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return s.violation(path, fmt.Sprintf("must match %s", s.Pattern))
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return &validationError{path, fmt.Sprintf("must be at least %v", *s.Minimum)}
+		}
+	case []interface{}:
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return &validationError{path, fmt.Sprintf("must contain at most %d items", *s.MaxItems)}
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, formats, false); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		if !partial {
+			for _, name := range s.Required {
+				if _, ok := v[name]; !ok {
+					return &validationError{joinField(path, name), "is required"}
+				}
+			}
+		}
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if value, ok := v[name]; ok {
+				if err := s.Properties[name].validate(joinField(path, name), value, formats, false); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if s.Format != "" {
+		if err := formats[s.Format](path, v); err != nil {
+			if s.ErrorMessage != "" {
+				err.Message = s.ErrorMessage
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// violation returns the error for a violation of a keyword whose message the
+// errorMessage keyword replaces.
+func (s *jsonSchema) violation(path, message string) *validationError {
+	if s.ErrorMessage != "" {
+		message = s.ErrorMessage
+	}
+	return &validationError{path, message}
+}
+
+func (s *jsonSchema) hasType(v interface{}) bool {
+	if len(s.Type) == 0 {
+		return true
+	}
+	for _, t := range s.Type {
+		switch v := v.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case float64:
+			if t == "number" || t == "integer" && v == math.Trunc(v) {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *jsonSchema) typeDescription() string {
+	names := make([]string, len(s.Type))
+	for i, t := range s.Type {
+		switch t {
+		case "array", "object", "integer":
+			names[i] = "an " + t
+		case "null":
+			names[i] = "null"
+		default:
+			names[i] = "a " + t
+		}
+	}
+	return strings.Join(names, " or ")
+}
+
+func (s *jsonSchema) inEnum(v interface{}) bool {
+	for _, e := range s.Enum {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *jsonSchema) enumDescription() string {
+	values := make([]string, len(s.Enum))
+	for i, e := range s.Enum {
+		data, _ := json.Marshal(e)
+		values[i] = string(data)
+	}
+	return strings.Join(values, ", ")
+}
+
+func joinField(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
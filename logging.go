@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/golang.org/x/net/context"
+	log "github.com/flynn/flynn-discovery/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+)
+
+// setupLogging configures the root logger to write records of at least level
+// to stderr in format, which is either "logfmt" or "json".
+func setupLogging(level, format string) error {
+	lvl, err := log.LvlFromString(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	var f log.Format
+	switch format {
+	case "logfmt":
+		f = log.LogfmtFormat()
+	case "json":
+		f = log.JsonFormat()
+	default:
+		return fmt.Errorf("invalid log format %q, expected logfmt or json", format)
+	}
+	log.Root().SetHandler(log.LvlFilterHandler(lvl, log.StreamHandler(os.Stderr, f)))
+	return nil
+}
+
+// validRequestID matches request IDs that are accepted from clients, others
+// are replaced so that clients can't inject arbitrary data into the logs.
+var validRequestID = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,128}$`)
+
+// quietRoutes are probed frequently, so their requests are logged at debug
+// level.
+var quietRoutes = map[string]bool{
+	"Healthz": true,
+	"Readyz":  true,
+	"Metrics": true,
+}
+
+// logRequests assigns each request an ID, which is returned in the
+// X-Request-Id header, and logs it when it completes. Handlers receive a
+// *httphelper.ResponseWriter whose context carries a logger tagged with the
+// request ID, which httphelper.Error uses to log unexpected errors.
+func logRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		reqID := req.Header.Get("X-Request-Id")
+		if !validRequestID.MatchString(reqID) {
+			reqID = newUUID()
+		}
+		w.Header().Set("X-Request-Id", reqID)
+
+		logger := log.New("req_id", reqID)
+		rec := &responseRecorder{ResponseWriter: w}
+		ctx := ctxhelper.NewContextRequestID(context.Background(), reqID)
+		ctx = ctxhelper.NewContextComponentName(ctx, "discovery")
+		ctx = ctxhelper.NewContextLogger(ctx, logger)
+		ctx = ctxhelper.NewContextStartTime(ctx, start)
+		ctx = context.WithValue(ctx, recorderKey, rec)
+		handler.ServeHTTP(httphelper.NewResponseWriter(rec, ctx), req)
+
+		duration := time.Since(start)
+		observeRequest(rec, duration)
+
+		fields := []interface{}{
+			"method", req.Method,
+			"path", req.URL.Path,
+			"route", rec.route,
+			"status", rec.Status(),
+			"duration", duration,
+			"client_ip", sourceIP(req),
+		}
+		for _, name := range []string{"cluster_id", "instance_id"} {
+			if id := rec.params.ByName(name); id != "" {
+				fields = append(fields, name, id)
+			}
+		}
+		if quietRoutes[rec.route] {
+			logger.Debug("request completed", fields...)
+		} else {
+			logger.Info("request completed", fields...)
+		}
+	})
+}
+
+// requestLogger returns the logger of the request that w responds to.
+func requestLogger(w http.ResponseWriter) log.Logger {
+	if rw, ok := w.(*httphelper.ResponseWriter); ok {
+		if logger, ok := ctxhelper.LoggerFromContext(rw.Context()); ok {
+			return logger
+		}
+	}
+	return log.Root()
+}
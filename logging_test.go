@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+
+	log "github.com/flynn/flynn-discovery/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+)
+
+// testLogHandler is the handler of the root logger in tests. Tests exercise
+// error paths, which are logged, so the logs are only shown with go test -v.
+var testLogHandler = log.DiscardHandler()
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if testing.Verbose() {
+		testLogHandler = log.StdoutHandler
+	}
+	log.Root().SetHandler(testLogHandler)
+	os.Exit(m.Run())
+}
+
+// captureLogs records the log records written until the returned function is
+// called.
+func captureLogs() (records func() []*log.Record, stop func()) {
+	var mtx sync.Mutex
+	var captured []*log.Record
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		captured = append(captured, r)
+		return nil
+	}))
+	records = func() []*log.Record {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return captured
+	}
+	return records, func() { log.Root().SetHandler(testLogHandler) }
+}
+
+// recordFields returns the context of r as a map.
+func recordFields(r *log.Record) map[string]interface{} {
+	fields := make(map[string]interface{}, len(r.Ctx)/2)
+	for i := 0; i+1 < len(r.Ctx); i += 2 {
+		if key, ok := r.Ctx[i].(string); ok {
+			fields[key] = r.Ctx[i+1]
+		}
+	}
+	return fields
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+func TestLogRequests(t *testing.T) {
+	s, cluster := newTestServer(t)
+	inst := createHTTPTestInstance(t, s, cluster, map[string]interface{}{"url": "http://10.0.0.1:1111"})
+	unknown := newUUID()
+	records, stop := captureLogs()
+	defer stop()
+
+	request := func(path, reqID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if reqID != "" {
+			req.Header.Set("X-Request-Id", reqID)
+		}
+		res := httptest.NewRecorder()
+		s.ServeHTTP(res, req)
+		return res
+	}
+
+	for _, test := range []struct {
+		name   string
+		path   string
+		reqID  string
+		level  log.Lvl
+		fields map[string]interface{}
+	}{
+		{
+			name:  "valid request ID",
+			path:  "/clusters/" + cluster.ID + "/instances/" + inst.ID,
+			reqID: "abc-123.DEF_456",
+			level: log.LvlInfo,
+			fields: map[string]interface{}{
+				"method":      "GET",
+				"route":       "GetInstance",
+				"status":      http.StatusOK,
+				"cluster_id":  cluster.ID,
+				"instance_id": inst.ID,
+				"client_ip":   "192.0.2.1",
+			},
+		},
+		{
+			name:   "invalid request ID",
+			path:   "/clusters/" + cluster.ID + "/instances/" + unknown,
+			reqID:  "injected\" msg=\"forged",
+			level:  log.LvlInfo,
+			fields: map[string]interface{}{"route": "GetInstance", "status": http.StatusNotFound, "instance_id": unknown},
+		},
+		{
+			name:   "no request ID",
+			path:   "/clusters/" + cluster.ID,
+			level:  log.LvlInfo,
+			fields: map[string]interface{}{"route": "GetCluster", "status": http.StatusOK, "cluster_id": cluster.ID},
+		},
+		{
+			name:   "quiet route",
+			path:   "/healthz",
+			level:  log.LvlDebug,
+			fields: map[string]interface{}{"route": "Healthz", "status": http.StatusOK},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			before := len(records())
+			res := request(test.path, test.reqID)
+			reqID := res.Header().Get("X-Request-Id")
+			if validRequestID.MatchString(test.reqID) {
+				if reqID != test.reqID {
+					t.Errorf("expected X-Request-Id %q to be echoed, got %q", test.reqID, reqID)
+				}
+			} else if !uuidPattern.MatchString(reqID) {
+				t.Errorf("expected X-Request-Id to be a new UUID, got %q", reqID)
+			}
+
+			logged := records()[before:]
+			if len(logged) != 1 {
+				t.Fatalf("expected 1 log record, got %d", len(logged))
+			}
+			r := logged[0]
+			if r.Msg != "request completed" || r.Lvl != test.level {
+				t.Errorf("expected %q at level %s, got %q at level %s", "request completed", test.level, r.Msg, r.Lvl)
+			}
+			fields := recordFields(r)
+			if fields["req_id"] != reqID {
+				t.Errorf("expected req_id %q, got %v", reqID, fields["req_id"])
+			}
+			for key, expected := range test.fields {
+				if fields[key] != expected {
+					t.Errorf("expected %s %v, got %v", key, expected, fields[key])
+				}
+			}
+			if _, ok := fields["instance_id"]; ok && test.fields["instance_id"] == nil {
+				t.Errorf("expected no instance_id, got %v", fields["instance_id"])
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const usage = `usage: flynn-discovery [<command>] [<args>...]
+
+Commands:
+  serve                 run the discovery server (the default)
+  cluster create        create a cluster and print its token URL
+  instance register     register an instance with a cluster
+  instance list         list the instances of a cluster
+  wait                  wait until a cluster has a given number of instances
+  migrate               apply pending database migrations
+  admin show            show a cluster as stored in the database
+  admin reset-secret    replace the secret of a cluster in the database
+  admin reap            remove expired instances from the database
+  admin gc              delete abandoned clusters from the database
+
+Commands that take a CLUSTER accept either a cluster token URL, which
+includes the cluster secret, or a cluster ID. Cluster IDs are resolved against
+$FLYNN_DISCOVERY_URL and sent with the secret in $FLYNN_DISCOVERY_SECRET.
+The migrate and admin commands connect to the database at $DATABASE_URL.
+
+Run 'flynn-discovery <command> -h' for the options of a command.
+`
+
+var commands = map[string]func(args []string) error{
+	"serve":              runServe,
+	"cluster create":     runClusterCreate,
+	"instance register":  runInstanceRegister,
+	"instance list":      runInstanceList,
+	"wait":               runWait,
+	"migrate":            runMigrate,
+	"admin show":         runAdminShow,
+	"admin reset-secret": runAdminResetSecret,
+	"admin reap":         runAdminReap,
+	"admin gc":           runAdminGC,
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	if args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fmt.Print(usage)
+		return
+	}
+
+	// commands write their output to stdout, so log to stderr
+	setupLogging("info", "logfmt")
+
+	name := args[0]
+	run, ok := commands[name]
+	if !ok && len(args) > 1 {
+		name = args[0] + " " + args[1]
+		run, ok = commands[name]
+	}
+	if !ok {
+		fmt.Fprintf(os.Stderr, "flynn-discovery: unknown command %q\n\n%s", strings.Join(args, " "), usage)
+		os.Exit(2)
+	}
+
+	if err := run(args[len(strings.Fields(name)):]); err != nil {
+		fmt.Fprintln(os.Stderr, "flynn-discovery:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+func NewMemoryBackend() StorageBackend {
+	return &MemoryBackend{
+		clusters:  make(map[string]*discovery.Cluster),
+		instances: make(map[string][]*discovery.Instance),
+		events:    make(map[string][]*Event),
+	}
+}
+
+// MemoryBackend is a StorageBackend that keeps all data in process memory. It
+// mirrors the behaviour of PostgresBackend and is intended for development
+// and tests.
+type MemoryBackend struct {
+	mtx       sync.RWMutex
+	clusters  map[string]*discovery.Cluster
+	instances map[string][]*discovery.Instance // keyed by cluster ID, in insertion order
+	events    map[string][]*Event              // keyed by cluster ID, in index order
+	notifier  clusterNotifier
+}
+
+func (b *MemoryBackend) CreateCluster(cluster *discovery.Cluster) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	cluster.ID = newUUID()
+	cluster.CreatedAt = now()
+	cluster.ActiveAt = cluster.CreatedAt
+	c := *cluster
+	c.Secret = ""
+	b.clusters[cluster.ID] = &c
+	return nil
+}
+
+func (b *MemoryBackend) CreateInstance(inst *discovery.Instance) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	clusterID, ok := normalizeUUID(inst.ClusterID)
+	if !ok {
+		return ErrNotFound
+	}
+	cluster, ok := b.clusters[clusterID]
+	if !ok {
+		return ErrNotFound
+	}
+	now := now()
+	for i, existing := range b.instances[clusterID] {
+		if existing.URL != inst.URL {
+			continue
+		}
+		if !isLive(existing, now) {
+			// an expired instance that has not been reaped yet must not
+			// block the URL from being registered again
+			b.removeInstance(clusterID, i, EventInstanceExpired)
+			break
+		}
+		*inst = *copyInstance(existing)
+		return ErrExists
+	}
+	if inst.ID != "" {
+		id, ok := normalizeUUID(inst.ID)
+		if !ok {
+			return ErrNotFound
+		}
+		inst.ID = id
+		for cid, instances := range b.instances {
+			for _, existing := range instances {
+				if existing.ID != id {
+					continue
+				}
+				if cid == clusterID {
+					*inst = *copyInstance(existing)
+				}
+				return ErrExists
+			}
+		}
+	}
+	if isComplete(cluster.Size, b.liveInstanceCount(clusterID, now)) {
+		return ErrClusterFull
+	}
+
+	if inst.SSHPublicKeys == nil {
+		inst.SSHPublicKeys = []discovery.SSHPublicKey{}
+	}
+	if inst.ID == "" {
+		inst.ID = newUUID()
+	}
+	inst.ClusterID = clusterID
+	inst.CreatedAt = &now
+	inst.UpdatedAt = &now
+	inst.ExpiresAt = nil
+	if inst.TTL > 0 {
+		expiresAt := now.Add(time.Duration(inst.TTL) * time.Second)
+		inst.ExpiresAt = &expiresAt
+	}
+	inst.Index = b.modified(clusterID, EventInstanceCreated, inst)
+	inst.CreatedIndex = inst.Index
+	stored := copyInstance(inst)
+	stored.Secret = ""
+	b.instances[clusterID] = append(b.instances[clusterID], stored)
+	return nil
+}
+
+func (b *MemoryBackend) GetClusterInstances(clusterID string) ([]*discovery.Instance, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	clusterID, ok := normalizeUUID(clusterID)
+	if !ok {
+		return nil, nil
+	}
+	now := now()
+	var instances []*discovery.Instance
+	for _, inst := range b.instances[clusterID] {
+		if isLive(inst, now) {
+			instances = append(instances, copyInstance(inst))
+		}
+	}
+	return instances, nil
+}
+
+func (b *MemoryBackend) GetCluster(clusterID string) (*discovery.Cluster, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	clusterID, _ = normalizeUUID(clusterID)
+	cluster, ok := b.clusters[clusterID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *cluster
+	c.InstanceCount = b.liveInstanceCount(clusterID, now())
+	c.Complete = isComplete(c.Size, c.InstanceCount)
+	return &c, nil
+}
+
+func (b *MemoryBackend) SetClusterSecret(clusterID, oldHash, newHash string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	clusterID, _ = normalizeUUID(clusterID)
+	cluster, ok := b.clusters[clusterID]
+	if !ok {
+		return ErrNotFound
+	}
+	if cluster.SecretHash != oldHash {
+		return ErrConflict
+	}
+	cluster.SecretHash = newHash
+	return nil
+}
+
+func (b *MemoryBackend) GetInstance(clusterID, instanceID string) (*discovery.Instance, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	clusterID, i := b.findInstance(clusterID, instanceID)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	return copyInstance(b.instances[clusterID][i]), nil
+}
+
+func (b *MemoryBackend) DeleteInstance(clusterID, instanceID string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	clusterID, i := b.findInstance(clusterID, instanceID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	b.removeInstance(clusterID, i, EventInstanceDeleted)
+	return nil
+}
+
+func (b *MemoryBackend) HeartbeatInstance(clusterID, instanceID string) (*discovery.Instance, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	clusterID, i := b.findInstance(clusterID, instanceID)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	inst := b.instances[clusterID][i]
+	now := now()
+	if inst.TTL > 0 {
+		expiresAt := now.Add(time.Duration(inst.TTL) * time.Second)
+		inst.ExpiresAt = &expiresAt
+	}
+	b.clusters[clusterID].ActiveAt = now
+	return copyInstance(inst), nil
+}
+
+func (b *MemoryBackend) UpdateInstance(clusterID, instanceID string, update *InstanceUpdate, index int64) (*discovery.Instance, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	clusterID, i := b.findInstance(clusterID, instanceID)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	inst := b.instances[clusterID][i]
+	if index != 0 && inst.Index != index {
+		return nil, ErrConflict
+	}
+	update.apply(inst)
+	inst.SSHPublicKeys = copySSHPublicKeys(inst.SSHPublicKeys)
+	if inst.SSHPublicKeys == nil {
+		inst.SSHPublicKeys = []discovery.SSHPublicKey{}
+	}
+	updatedAt := now()
+	inst.UpdatedAt = &updatedAt
+	inst.Index = b.modified(clusterID, EventInstanceUpdated, inst)
+	return copyInstance(inst), nil
+}
+
+func (b *MemoryBackend) DeleteExpiredInstances() ([]*discovery.Instance, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := now()
+	var expired []*discovery.Instance
+	for clusterID, instances := range b.instances {
+		live := instances[:0:0]
+		for _, inst := range instances {
+			if isLive(inst, now) {
+				live = append(live, inst)
+			} else {
+				expired = append(expired, inst)
+				b.modified(clusterID, EventInstanceExpired, inst)
+			}
+		}
+		b.instances[clusterID] = live
+	}
+	return expired, nil
+}
+
+func (b *MemoryBackend) DeleteAbandonedClusters(emptyBefore, inactiveBefore time.Time, limit int, dryRun bool) ([]*discovery.Cluster, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := now()
+	var abandoned []*discovery.Cluster
+	for id, cluster := range b.clusters {
+		count := b.liveInstanceCount(id, now)
+		empty := !emptyBefore.IsZero() && cluster.CreatedAt.Before(emptyBefore) && count == 0
+		inactive := !inactiveBefore.IsZero() && cluster.ActiveAt.Before(inactiveBefore)
+		if !empty && !inactive {
+			continue
+		}
+		c := *cluster
+		c.InstanceCount = count
+		c.Complete = isComplete(c.Size, c.InstanceCount)
+		abandoned = append(abandoned, &c)
+	}
+	// delete the oldest clusters first, like PostgresBackend
+	sort.Sort(clustersByCreatedAt(abandoned))
+	if limit > 0 && len(abandoned) > limit {
+		abandoned = abandoned[:limit]
+	}
+	if dryRun {
+		return abandoned, nil
+	}
+	for _, cluster := range abandoned {
+		delete(b.clusters, cluster.ID)
+		delete(b.instances, cluster.ID)
+		delete(b.events, cluster.ID)
+	}
+	return abandoned, nil
+}
+
+type clustersByCreatedAt []*discovery.Cluster
+
+func (c clustersByCreatedAt) Len() int           { return len(c) }
+func (c clustersByCreatedAt) Less(i, j int) bool { return c[i].CreatedAt.Before(c[j].CreatedAt) }
+func (c clustersByCreatedAt) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+func (b *MemoryBackend) GetEvents(clusterID string, afterIndex int64) ([]*Event, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	clusterID, ok := normalizeUUID(clusterID)
+	if !ok {
+		return nil, nil
+	}
+	var events []*Event
+	for _, event := range b.events[clusterID] {
+		if event.ID > afterIndex {
+			e := *event
+			e.Instance = copyInstance(event.Instance)
+			events = append(events, &e)
+		}
+	}
+	return events, nil
+}
+
+func (b *MemoryBackend) SubscribeCluster(clusterID string) (<-chan int64, func()) {
+	return b.notifier.subscribe(clusterID)
+}
+
+// liveInstanceCount returns the number of instances in the cluster that have
+// not expired. The caller must hold b.mtx.
+func (b *MemoryBackend) liveInstanceCount(clusterID string, now time.Time) int {
+	var n int
+	for _, inst := range b.instances[clusterID] {
+		if isLive(inst, now) {
+			n++
+		}
+	}
+	return n
+}
+
+// removeInstance removes the instance at index i from the cluster's instance
+// list and records an event of type typ. The caller must hold b.mtx.
+func (b *MemoryBackend) removeInstance(clusterID string, i int, typ EventType) {
+	instances := b.instances[clusterID]
+	inst := instances[i]
+	b.instances[clusterID] = append(instances[:i:i], instances[i+1:]...)
+	b.modified(clusterID, typ, inst)
+}
+
+// modified increments the modification index of the cluster, records an
+// event of type typ for inst, notifies subscribers and returns the new index.
+// The caller must hold b.mtx.
+func (b *MemoryBackend) modified(clusterID string, typ EventType, inst *discovery.Instance) int64 {
+	cluster := b.clusters[clusterID]
+	cluster.Index++
+	cluster.ActiveAt = now()
+	event := &Event{
+		ID:        cluster.Index,
+		ClusterID: clusterID,
+		Type:      typ,
+		Instance:  copyInstance(inst),
+		CreatedAt: now(),
+	}
+	event.Instance.Secret = ""
+	event.Instance.Index = cluster.Index
+	if typ == EventInstanceCreated {
+		event.Instance.CreatedIndex = cluster.Index
+	}
+	b.events[clusterID] = append(b.events[clusterID], event)
+	b.notifier.notify(clusterID, cluster.Index)
+	return cluster.Index
+}
+
+// findInstance returns the normalized cluster ID and the index of the given
+// instance in that cluster's instance list, or -1 if it does not exist. The
+// caller must hold b.mtx.
+func (b *MemoryBackend) findInstance(clusterID, instanceID string) (string, int) {
+	clusterID, ok := normalizeUUID(clusterID)
+	if !ok {
+		return "", -1
+	}
+	instanceID, ok = normalizeUUID(instanceID)
+	if !ok {
+		return "", -1
+	}
+	now := now()
+	for i, inst := range b.instances[clusterID] {
+		if inst.ID == instanceID && isLive(inst, now) {
+			return clusterID, i
+		}
+	}
+	return "", -1
+}
+
+func isLive(inst *discovery.Instance, now time.Time) bool {
+	return inst.ExpiresAt == nil || inst.ExpiresAt.After(now)
+}
+
+func copyInstance(inst *discovery.Instance) *discovery.Instance {
+	c := *inst
+	if inst.CreatedAt != nil {
+		createdAt := *inst.CreatedAt
+		c.CreatedAt = &createdAt
+	}
+	if inst.UpdatedAt != nil {
+		updatedAt := *inst.UpdatedAt
+		c.UpdatedAt = &updatedAt
+	}
+	if inst.ExpiresAt != nil {
+		expiresAt := *inst.ExpiresAt
+		c.ExpiresAt = &expiresAt
+	}
+	c.SSHPublicKeys = copySSHPublicKeys(inst.SSHPublicKeys)
+	if inst.PeerURLs != nil {
+		c.PeerURLs = append([]string(nil), inst.PeerURLs...)
+	}
+	return &c
+}
+
+func copySSHPublicKeys(keys []discovery.SSHPublicKey) []discovery.SSHPublicKey {
+	if keys == nil {
+		return nil
+	}
+	c := make([]discovery.SSHPublicKey, len(keys))
+	for i, k := range keys {
+		c[i] = discovery.SSHPublicKey{Type: k.Type, Data: append([]byte{}, k.Data...), Fingerprint: k.Fingerprint}
+	}
+	return c
+}
+
+// now returns the current time with the same precision as a Postgres
+// timestamptz.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+func newUUID() string {
+	id, _ := normalizeUUID(random.UUID())
+	return id
+}
+
+// normalizeUUID converts id into the canonical lowercase, hyphenated form
+// that Postgres returns for uuid columns. Like Postgres it accepts upper case
+// digits, missing hyphens and surrounding braces. ok is false if id is not a
+// valid UUID.
+func normalizeUUID(id string) (string, bool) {
+	id = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(id, "{"), "}"))
+	id = strings.Replace(id, "-", "", -1)
+	if len(id) != 32 {
+		return "", false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return "", false
+		}
+	}
+	return id[0:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:], true
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/jackc/pgx"
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+)
+
+var (
+	httpRequests = newCounterVec("discovery_http_requests_total",
+		"Number of HTTP requests by route and status code.", "route", "code")
+	httpRequestDuration = newHistogramVec("discovery_http_request_duration_seconds",
+		"Latency of HTTP requests by route.", []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 60}, "route")
+	httpErrors = newCounterVec("discovery_http_errors_total",
+		"Number of error responses by route and error code.", "route", "code")
+	clustersCreated = newCounterVec("discovery_clusters_created_total",
+		"Number of clusters created.")
+	instancesRegistered = newCounterVec("discovery_instances_registered_total",
+		"Number of instances registered.")
+	instanceConflicts = newCounterVec("discovery_instance_conflicts_total",
+		"Number of instance registrations rejected because the URL was already registered.")
+	instancesExpired = newCounterVec("discovery_instances_expired_total",
+		"Number of expired instances removed by the reaper.")
+	storageErrors = newCounterVec("discovery_storage_errors_total",
+		"Number of failed storage backend operations by operation and Postgres error code.", "op", "code")
+)
+
+// countStorageError counts err as a failure of the storage backend operation
+// op. The errors backends return for expected conditions, like ErrNotFound,
+// are not failures. Failures are labeled with the SQLSTATE code of Postgres
+// errors, or "unknown" for other errors like connection failures.
+func countStorageError(op string, err error) {
+	switch err {
+	case nil, ErrNotFound, ErrExists, ErrConflict, ErrClusterFull:
+		return
+	}
+	code := "unknown"
+	if pgErr, ok := err.(pgx.PgError); ok {
+		code = pgErr.Code
+	}
+	storageErrors.inc(op, code)
+}
+
+// counterVec is a Prometheus counter partitioned by label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mtx    sync.Mutex
+	values map[string]float64 // keyed by joined label values
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.values[strings.Join(labelValues, "\xff")] += v
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	if len(c.labels) == 0 {
+		// unlabeled counters are always exported
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, splitKey(key)), formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec is a Prometheus histogram partitioned by label values.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mtx    sync.Mutex
+	values map[string]*histogram // keyed by joined label values
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		values := splitKey(key)
+		labels := append(append([]string{}, h.labels...), "le")
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(values, formatFloat(upper))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(values, "+Inf")), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), hist.count)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + labelEscaper.Replace(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitKey(key string) []string {
+	return strings.Split(key, "\xff")
+}
+
+// Metrics serves the metrics in the Prometheus text format.
+func (s *Server) Metrics(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var buf bytes.Buffer
+	for _, c := range []interface {
+		write(io.Writer)
+	}{
+		httpRequests, httpRequestDuration, httpErrors,
+		clustersCreated, instancesRegistered, instanceConflicts, instancesExpired,
+		storageErrors,
+	} {
+		c.write(&buf)
+	}
+
+	writeHeader(&buf, "discovery_gc_runs_total", "Number of garbage collection runs.", "counter")
+	fmt.Fprintf(&buf, "discovery_gc_runs_total %d\n", atomic.LoadInt64(&gcStats.Runs))
+	writeHeader(&buf, "discovery_gc_errors_total", "Number of failed garbage collection runs.", "counter")
+	fmt.Fprintf(&buf, "discovery_gc_errors_total %d\n", atomic.LoadInt64(&gcStats.Errors))
+	writeHeader(&buf, "discovery_gc_clusters_deleted_total", "Number of abandoned clusters deleted by reason.", "counter")
+	fmt.Fprintf(&buf, "discovery_gc_clusters_deleted_total{reason=\"empty\"} %d\n", atomic.LoadInt64(&gcStats.EmptyClusters))
+	fmt.Fprintf(&buf, "discovery_gc_clusters_deleted_total{reason=\"inactive\"} %d\n", atomic.LoadInt64(&gcStats.InactiveClusters))
+
+	if pg, ok := s.Backend.(*PostgresBackend); ok {
+		stat := pg.db.Stat()
+		writeGauge(&buf, "discovery_postgres_pool_max_connections", "Maximum number of connections in the Postgres pool.", float64(stat.MaxConnections))
+		writeGauge(&buf, "discovery_postgres_pool_connections", "Number of open connections in the Postgres pool.", float64(stat.CurrentConnections))
+		writeGauge(&buf, "discovery_postgres_pool_available_connections", "Number of idle connections in the Postgres pool.", float64(stat.AvailableConnections))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// instrument names the route of requests handled by handle, which labels the
+// request metrics and logs.
+func instrument(route string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if rw, ok := w.(*httphelper.ResponseWriter); ok {
+			if rec, ok := rw.Context().Value(recorderKey).(*responseRecorder); ok {
+				rec.route = route
+				rec.params = params
+			}
+		}
+		handle(w, req, params)
+	}
+}
+
+// observeRequest records the count, latency and error code of a request to
+// a named route.
+func observeRequest(rec *responseRecorder, duration time.Duration) {
+	if rec.route == "" {
+		return
+	}
+	status := rec.Status()
+	httpRequests.inc(rec.route, strconv.Itoa(status))
+	httpRequestDuration.observe(duration.Seconds(), rec.route)
+	if status >= 400 {
+		var jsonErr struct {
+			Code string `json:"code"`
+		}
+		json.Unmarshal(rec.body, &jsonErr)
+		if jsonErr.Code == "" {
+			jsonErr.Code = "unknown"
+		}
+		httpErrors.inc(rec.route, jsonErr.Code)
+	}
+}
+
+type contextKey int
+
+// recorderKey is the context key of the request's *responseRecorder.
+const recorderKey contextKey = 0
+
+// responseRecorder records the status code of a response and the body of
+// error responses, which are small JSON errors, as well as the route that
+// handled the request.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+
+	route  string
+	params httprouter.Params
+}
+
+// Status returns the status code of the response, which is 200 if no
+// response was written.
+func (r *responseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.status >= 400 && len(r.body) < 4096 {
+		r.body = append(r.body, p...)
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) CloseNotify() <-chan bool {
+	if cn, ok := r.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
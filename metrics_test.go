@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/jackc/pgx"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// resetMetrics clears the metrics, which are shared by all tests.
+func resetMetrics() {
+	for _, c := range []*counterVec{
+		httpRequests, httpErrors, clustersCreated, instancesRegistered,
+		instanceConflicts, instancesExpired, storageErrors,
+	} {
+		c.values = make(map[string]float64)
+	}
+	httpRequestDuration.values = make(map[string]*histogram)
+	gcStats.Runs, gcStats.Errors, gcStats.EmptyClusters, gcStats.InactiveClusters = 0, 0, 0, 0
+}
+
+func TestMetrics(t *testing.T) {
+	resetMetrics()
+	defer resetMetrics()
+
+	httpRequests.inc("CreateCluster", "201")
+	httpRequests.inc("GetInstances", "200")
+	httpRequests.inc("GetInstances", "200")
+	httpRequests.inc("GetInstances", "404")
+	httpRequestDuration.observe(0.003, "CreateCluster")
+	httpRequestDuration.observe(0.02, "GetInstances")
+	httpRequestDuration.observe(30, "GetInstances")
+	httpRequestDuration.observe(120, "GetInstances")
+	httpErrors.inc("GetInstances", "not_found")
+	clustersCreated.inc()
+	instancesRegistered.add(3)
+	instanceConflicts.inc()
+	instancesExpired.add(2)
+	gcStats.Runs, gcStats.Errors, gcStats.EmptyClusters, gcStats.InactiveClusters = 4, 1, 5, 6
+
+	// expected errors are not counted
+	countStorageError("GetCluster", nil)
+	countStorageError("GetCluster", ErrNotFound)
+	countStorageError("CreateInstance", ErrExists)
+	countStorageError("UpdateInstance", ErrConflict)
+	countStorageError("CreateInstance", ErrClusterFull)
+	countStorageError("GetCluster", errors.New("connection refused"))
+	countStorageError("GetCluster", errors.New("connection refused"))
+	countStorageError("CreateInstance", errors.New("connection refused"))
+	countStorageError("CreateInstance", pgx.PgError{Code: "57014" /*query_canceled*/})
+
+	s := NewServer("", NewMemoryBackend())
+	res := httptest.NewRecorder()
+	s.Metrics(res, httptest.NewRequest("GET", "/metrics", nil), nil)
+	if ct := res.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("expected Prometheus text format content type, got %q", ct)
+	}
+
+	golden := "testdata/metrics.golden"
+	if *updateGolden {
+		if err := ioutil.WriteFile(golden, res.Body.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Body.String() != string(expected) {
+		t.Errorf("unexpected metrics, run go test -run TestMetrics -update to see the difference with git diff\ngot:\n%s", res.Body)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/jackc/pgx"
+)
+
+type migration struct {
+	ID   int
+	Name string
+	SQL  string
+}
+
+// migrations brings the database schema up to date. They are applied in
+// order, each in its own transaction, and recorded in schema_migrations.
+// Released migrations must never be changed, add a new one instead.
+var migrations = []migration{
+	// Databases created from the original schema.sql already have these
+	// tables, so they are only created if they don't exist.
+	{1, "create clusters and instances", `
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+CREATE TABLE IF NOT EXISTS clusters (
+  cluster_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+  creator_ip text NOT NULL,
+  creator_user_agent text NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS instances (
+  instance_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+  cluster_id uuid NOT NULL REFERENCES clusters (cluster_id),
+  flynn_version text NOT NULL,
+  ssh_public_keys json NOT NULL,
+  url text NOT NULL,
+  name text NOT NULL,
+  creator_ip text NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  UNIQUE(cluster_id, url)
+);
+`},
+	// Before migrations were introduced, schema.sql gained these columns one
+	// release at a time, so databases created from any of its versions may
+	// already have some of them.
+	{2, "add expiry, secrets, cluster sizes and instance events", `
+ALTER TABLE clusters
+  ADD COLUMN IF NOT EXISTS modified_index bigint NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS size integer NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS secret_hash text,
+  ADD COLUMN IF NOT EXISTS private boolean NOT NULL DEFAULT false;
+
+ALTER TABLE instances
+  ADD COLUMN IF NOT EXISTS updated_at timestamptz,
+  ADD COLUMN IF NOT EXISTS ttl integer NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS expires_at timestamptz,
+  ADD COLUMN IF NOT EXISTS modified_index bigint NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS secret_hash text;
+UPDATE instances SET updated_at = created_at WHERE updated_at IS NULL;
+ALTER TABLE instances
+  ALTER COLUMN updated_at SET NOT NULL,
+  ALTER COLUMN updated_at SET DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS instances_expires_at_idx ON instances (expires_at) WHERE expires_at IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS instance_events (
+  cluster_id uuid NOT NULL REFERENCES clusters (cluster_id),
+  event_id bigint NOT NULL,
+  type text NOT NULL,
+  instance json NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  PRIMARY KEY (cluster_id, event_id)
+);
+
+-- instances_modified increments the modification index of the cluster when
+-- an instance is added, changed or removed, stores it on the instance, records
+-- an event and notifies listeners on the "instances" channel with
+-- "<cluster_id>:<index>". It also rejects new instances once the cluster has
+-- reached its size.
+CREATE OR REPLACE FUNCTION instances_modified() RETURNS trigger AS $$
+DECLARE
+  inst instances%ROWTYPE;
+  cid uuid;
+  idx bigint;
+  sz integer;
+  typ text;
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    inst := OLD;
+  ELSE
+    inst := NEW;
+  END IF;
+  cid := inst.cluster_id;
+  UPDATE clusters SET modified_index = modified_index + 1 WHERE cluster_id = cid RETURNING modified_index, size INTO idx, sz;
+  IF NOT FOUND THEN
+    -- leave it to the foreign key to reject the instance
+    RETURN NEW;
+  END IF;
+  -- the update above locks the cluster, so concurrent inserts can't both pass
+  -- this check. Duplicate URLs are left to the unique constraint so that
+  -- existing instances can still register again.
+  IF TG_OP = 'INSERT' AND sz > 0
+     AND NOT EXISTS (SELECT 1 FROM instances WHERE cluster_id = cid AND url = NEW.url)
+     AND (SELECT count(*) FROM instances WHERE cluster_id = cid AND (expires_at IS NULL OR expires_at > now())) >= sz THEN
+    RAISE EXCEPTION 'cluster is full' USING ERRCODE = 'check_violation', CONSTRAINT = 'instances_cluster_size';
+  END IF;
+
+  IF TG_OP = 'INSERT' THEN
+    typ := 'instance_created';
+  ELSIF TG_OP = 'UPDATE' THEN
+    typ := 'instance_updated';
+  ELSIF OLD.expires_at IS NOT NULL AND OLD.expires_at <= now() THEN
+    typ := 'instance_expired';
+  ELSE
+    typ := 'instance_deleted';
+  END IF;
+  INSERT INTO instance_events (cluster_id, event_id, type, instance) VALUES (cid, idx, typ, json_build_object(
+    'id', inst.instance_id, 'cluster_id', cid, 'flynn_version', inst.flynn_version,
+    'ssh_public_keys', inst.ssh_public_keys, 'url', inst.url, 'name', inst.name,
+    'created_at', inst.created_at, 'updated_at', inst.updated_at, 'ttl', inst.ttl, 'expires_at', inst.expires_at, 'index', idx
+  ));
+
+  PERFORM pg_notify('instances', cid::text || ':' || idx::text);
+  IF TG_OP = 'DELETE' THEN
+    RETURN OLD;
+  END IF;
+  NEW.modified_index := idx;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS instances_modified ON instances;
+DROP TRIGGER IF EXISTS instances_updated ON instances;
+CREATE TRIGGER instances_modified BEFORE INSERT OR DELETE ON instances
+  FOR EACH ROW EXECUTE PROCEDURE instances_modified();
+CREATE TRIGGER instances_updated BEFORE UPDATE OF flynn_version, ssh_public_keys, url, name ON instances
+  FOR EACH ROW EXECUTE PROCEDURE instances_modified();
+`},
+	{3, "track cluster activity", `
+ALTER TABLE clusters ADD COLUMN active_at timestamptz;
+UPDATE clusters c SET active_at = greatest(created_at, (SELECT max(created_at) FROM instance_events e WHERE e.cluster_id = c.cluster_id));
+ALTER TABLE clusters
+  ALTER COLUMN active_at SET NOT NULL,
+  ALTER COLUMN active_at SET DEFAULT now();
+
+CREATE INDEX ON clusters (created_at);
+CREATE INDEX ON clusters (active_at);
+
+-- clusters are active whenever the instances_modified trigger increments
+-- their modification index
+CREATE FUNCTION clusters_active() RETURNS trigger AS $$
+BEGIN
+  NEW.active_at := now();
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER clusters_active BEFORE UPDATE OF modified_index ON clusters
+  FOR EACH ROW EXECUTE PROCEDURE clusters_active();
+`},
+	{4, "add shared rate limits", `
+CREATE TABLE rate_limits (
+  key text PRIMARY KEY,
+  tokens double precision NOT NULL,
+  updated_at timestamptz NOT NULL DEFAULT now(),
+  full_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON rate_limits (full_at);
+`},
+	{5, "add peer URLs and creation indexes of instances", `
+ALTER TABLE instances
+  ADD COLUMN peer_urls json,
+  ADD COLUMN created_index bigint NOT NULL DEFAULT 0;
+-- the creation index of existing instances is unknown, the last modification
+-- is the closest to it
+UPDATE instances SET created_index = modified_index;
+
+-- instances_modified also stores the creation index of new instances and
+-- includes both new columns in events
+CREATE OR REPLACE FUNCTION instances_modified() RETURNS trigger AS $$
+DECLARE
+  inst instances%ROWTYPE;
+  cid uuid;
+  idx bigint;
+  sz integer;
+  typ text;
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    inst := OLD;
+  ELSE
+    inst := NEW;
+  END IF;
+  cid := inst.cluster_id;
+  UPDATE clusters SET modified_index = modified_index + 1 WHERE cluster_id = cid RETURNING modified_index, size INTO idx, sz;
+  IF NOT FOUND THEN
+    -- leave it to the foreign key to reject the instance
+    RETURN NEW;
+  END IF;
+  -- the update above locks the cluster, so concurrent inserts can't both pass
+  -- this check. Duplicate URLs are left to the unique constraint so that
+  -- existing instances can still register again.
+  IF TG_OP = 'INSERT' AND sz > 0
+     AND NOT EXISTS (SELECT 1 FROM instances WHERE cluster_id = cid AND url = NEW.url)
+     AND (SELECT count(*) FROM instances WHERE cluster_id = cid AND (expires_at IS NULL OR expires_at > now())) >= sz THEN
+    RAISE EXCEPTION 'cluster is full' USING ERRCODE = 'check_violation', CONSTRAINT = 'instances_cluster_size';
+  END IF;
+
+  IF TG_OP = 'INSERT' THEN
+    typ := 'instance_created';
+    NEW.created_index := idx;
+    inst.created_index := idx;
+  ELSIF TG_OP = 'UPDATE' THEN
+    typ := 'instance_updated';
+  ELSIF OLD.expires_at IS NOT NULL AND OLD.expires_at <= now() THEN
+    typ := 'instance_expired';
+  ELSE
+    typ := 'instance_deleted';
+  END IF;
+  INSERT INTO instance_events (cluster_id, event_id, type, instance) VALUES (cid, idx, typ, json_build_object(
+    'id', inst.instance_id, 'cluster_id', cid, 'flynn_version', inst.flynn_version,
+    'ssh_public_keys', inst.ssh_public_keys, 'url', inst.url, 'peer_urls', inst.peer_urls, 'name', inst.name,
+    'created_at', inst.created_at, 'updated_at', inst.updated_at, 'ttl', inst.ttl, 'expires_at', inst.expires_at, 'index', idx,
+    'created_index', inst.created_index
+  ));
+
+  PERFORM pg_notify('instances', cid::text || ':' || idx::text);
+  IF TG_OP = 'DELETE' THEN
+    RETURN OLD;
+  END IF;
+  NEW.modified_index := idx;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+`},
+}
+
+// migrationLockID is the key of the advisory lock held while migrating, so
+// that servers starting at the same time don't apply migrations concurrently.
+const migrationLockID = 0x666c796e6e // "flynn"
+
+// migrateDB applies all migrations that have not been applied to db yet and
+// reports them to out. If dryRun is true the pending migrations are printed
+// but not applied.
+func migrateDB(db *pgx.ConnPool, dryRun bool, out io.Writer) error {
+	conn, err := db.Acquire()
+	if err != nil {
+		return err
+	}
+	defer db.Release(conn)
+
+	if _, err := conn.Exec("SELECT pg_advisory_lock($1)", int64(migrationLockID)); err != nil {
+		return err
+	}
+	defer conn.Exec("SELECT pg_advisory_unlock($1)", int64(migrationLockID))
+
+	applied, err := appliedMigrations(conn)
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		if _, err := conn.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (id integer PRIMARY KEY, name text NOT NULL, applied_at timestamptz NOT NULL DEFAULT now())"); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.ID]; ok {
+			continue
+		}
+		if dryRun {
+			fmt.Fprintf(out, "-- migration %d: %s\n%s\n", m.ID, m.Name, m.SQL)
+			continue
+		}
+		if err := applyMigration(conn, m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %s", m.ID, m.Name, err)
+		}
+		fmt.Fprintf(out, "applied migration %d: %s\n", m.ID, m.Name)
+	}
+	return nil
+}
+
+func applyMigration(conn *pgx.Conn, m migration) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(m.SQL); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (id, name) VALUES ($1, $2)", int32(m.ID), m.Name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// appliedMigrations returns the time each applied migration was applied at,
+// keyed by migration ID.
+func appliedMigrations(conn *pgx.Conn) (map[int]time.Time, error) {
+	applied := make(map[int]time.Time)
+	rows, err := conn.Query("SELECT id, applied_at FROM schema_migrations")
+	if isPgError(err, "42P01" /*undefined table*/) {
+		return applied, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int32
+		var appliedAt time.Time
+		if err := rows.Scan(&id, &appliedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		applied[int(id)] = appliedAt
+	}
+	if err := rows.Err(); isPgError(err, "42P01" /*undefined table*/) {
+		// nothing has been migrated yet
+		return applied, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// migrationStatus reports whether each migration has been applied to db.
+func migrationStatus(db *pgx.ConnPool, out io.Writer) error {
+	conn, err := db.Acquire()
+	if err != nil {
+		return err
+	}
+	defer db.Release(conn)
+
+	applied, err := appliedMigrations(conn)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSTATUS")
+	for _, m := range migrations {
+		status := "pending"
+		if t, ok := applied[m.ID]; ok {
+			status = "applied at " + t.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.ID, m.Name, status)
+	}
+	return w.Flush()
+}
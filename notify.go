@@ -0,0 +1,53 @@
+package main
+
+import "sync"
+
+// clusterNotifier distributes cluster modification indexes to subscribers.
+// Backends use it to implement StorageBackend.SubscribeCluster.
+type clusterNotifier struct {
+	mtx  sync.Mutex
+	subs map[string]map[chan int64]struct{}
+}
+
+func (n *clusterNotifier) subscribe(clusterID string) (<-chan int64, func()) {
+	ch := make(chan int64, 1)
+	clusterID, ok := normalizeUUID(clusterID)
+	if !ok {
+		// there can't be any changes to a cluster that doesn't exist
+		return ch, func() {}
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.subs == nil {
+		n.subs = make(map[string]map[chan int64]struct{})
+	}
+	if n.subs[clusterID] == nil {
+		n.subs[clusterID] = make(map[chan int64]struct{})
+	}
+	n.subs[clusterID][ch] = struct{}{}
+
+	return ch, func() {
+		n.mtx.Lock()
+		defer n.mtx.Unlock()
+		delete(n.subs[clusterID], ch)
+		if len(n.subs[clusterID]) == 0 {
+			delete(n.subs, clusterID)
+		}
+	}
+}
+
+// notify sends index to every subscriber of the cluster without blocking. A
+// subscriber that has not received the previous index yet only gets the
+// latest one.
+func (n *clusterNotifier) notify(clusterID string, index int64) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	for ch := range n.subs[clusterID] {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- index
+	}
+}
@@ -2,74 +2,479 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/jackc/pgx"
+	log "github.com/flynn/flynn-discovery/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	"github.com/flynn/flynn-discovery/discovery"
 )
 
 func NewPostgresBackend(db *pgx.ConnPool) StorageBackend {
-	return &PostgresBackend{db: db}
+	b := &PostgresBackend{
+		db:   db,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go b.listen()
+	return b
 }
 
 type PostgresBackend struct {
-	db *pgx.ConnPool
+	db       *pgx.ConnPool
+	notifier clusterNotifier
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Close stops listening for notifications and releases the listener's
+// connection back to the pool.
+func (b *PostgresBackend) Close() {
+	close(b.stop)
+	<-b.done
+}
+
+// CheckHealth checks that the database responds within timeout and that all
+// migrations have been applied.
+func (b *PostgresBackend) CheckHealth(timeout time.Duration) error {
+	// pgx does not support timeouts on queries, so abandon the check instead
+	// and let it finish in the background
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := b.db.Acquire()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer b.db.Release(conn)
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			errc <- err
+			return
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.ID]; !ok {
+				errc <- fmt.Errorf("migration %d (%s) has not been applied", m.ID, m.Name)
+				return
+			}
+		}
+		errc <- nil
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("database did not respond within %s", timeout)
+	}
 }
 
-func (b *PostgresBackend) CreateCluster(cluster *Cluster) error {
-	return b.db.QueryRow("INSERT INTO clusters (creator_ip, creator_user_agent) VALUES ($1, $2) RETURNING cluster_id, created_at",
-		cluster.CreatorIP, cluster.CreatorUserAgent).Scan(&cluster.ID, &cluster.CreatedAt)
+func (b *PostgresBackend) CreateCluster(cluster *discovery.Cluster) error {
+	return b.db.QueryRow("INSERT INTO clusters (creator_ip, creator_user_agent, size, secret_hash, private) VALUES ($1, $2, $3, $4, $5) RETURNING cluster_id, created_at",
+		cluster.CreatorIP, cluster.CreatorUserAgent, int32(cluster.Size), nullString(cluster.SecretHash), cluster.Private).Scan(&cluster.ID, &cluster.CreatedAt)
 }
 
-func (b *PostgresBackend) CreateInstance(inst *Instance) error {
+func (b *PostgresBackend) CreateInstance(inst *discovery.Instance) error {
 	if inst.SSHPublicKeys == nil {
-		inst.SSHPublicKeys = []SSHPublicKey{}
+		inst.SSHPublicKeys = []discovery.SSHPublicKey{}
+	}
+	// an expired instance that has not been reaped yet must not block the URL
+	// from being registered again
+	_, err := b.db.Exec("DELETE FROM instances WHERE cluster_id = $1 AND url = $2 AND NOT "+instanceLive, inst.ClusterID, inst.URL)
+	if isPgError(err, "22P02" /*invalid input syntax*/) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
 	}
 	// pgx doesn't like unmarshalling into **time.Time
 	inst.CreatedAt = &time.Time{}
+	inst.UpdatedAt = &time.Time{}
+	var expiresAt pgx.NullTime
 	sshKeys, _ := json.Marshal(inst.SSHPublicKeys)
-	err := b.db.QueryRow("INSERT INTO instances (cluster_id, flynn_version, ssh_public_keys, url, name, creator_ip) VALUES ($1, $2, $3, $4, $5, $6) RETURNING instance_id, created_at",
-		inst.ClusterID, inst.FlynnVersion, string(sshKeys), inst.URL, inst.Name, inst.CreatorIP).Scan(&inst.ID, inst.CreatedAt)
-	if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ && pgErr.ConstraintName == "instances_cluster_id_url_key" {
-		row := b.db.QueryRow("SELECT instance_id, flynn_version, ssh_public_keys, url, name, creator_ip, created_at FROM instances WHERE cluster_id = $1 AND url = $2", inst.ClusterID, inst.URL)
-		if err := scanInstance(row, inst); err != nil {
+	var peerURLs []byte
+	if len(inst.PeerURLs) > 0 {
+		peerURLs, _ = json.Marshal(inst.PeerURLs)
+	}
+	err = b.db.QueryRow("INSERT INTO instances (instance_id, cluster_id, flynn_version, ssh_public_keys, url, name, creator_ip, ttl, expires_at, secret_hash, peer_urls) VALUES (coalesce($9::uuid, uuid_generate_v4()), $1, $2, $3, $4, $5, $6, $7, CASE WHEN $7::integer > 0 THEN now() + $7::integer * interval '1 second' END, $8, $10::json) RETURNING instance_id, created_at, updated_at, expires_at, modified_index, created_index",
+		inst.ClusterID, inst.FlynnVersion, string(sshKeys), inst.URL, inst.Name, inst.CreatorIP, int32(inst.TTL), nullString(inst.SecretHash), nullString(inst.ID), nullString(string(peerURLs))).Scan(&inst.ID, inst.CreatedAt, inst.UpdatedAt, &expiresAt, &inst.Index, &inst.CreatedIndex)
+	if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+		var row *pgx.Row
+		switch pgErr.ConstraintName {
+		case "instances_cluster_id_url_key":
+			row = b.db.QueryRow("SELECT "+instanceFields+" FROM instances WHERE cluster_id = $1 AND url = $2", inst.ClusterID, inst.URL)
+		case "instances_pkey":
+			row = b.db.QueryRow("SELECT "+instanceFields+" FROM instances WHERE cluster_id = $1 AND instance_id = $2", inst.ClusterID, inst.ID)
+		default:
+			return err
+		}
+		// an instance with the same ID in another cluster is not disclosed
+		if err := scanInstance(row, inst); err != nil && err != pgx.ErrNoRows {
 			return err
 		}
 		return ErrExists
 	}
-	return err
+	if isPgError(err, "23503" /*foreign key violation*/) || isPgError(err, "22P02" /*invalid input syntax*/) {
+		return ErrNotFound
+	} else if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "23514" /*check violation*/ && pgErr.ConstraintName == "instances_cluster_size" {
+		return ErrClusterFull
+	} else if err != nil {
+		return err
+	}
+	inst.ExpiresAt = nullTime(expiresAt)
+	return nil
+}
+
+func isPgError(err error, code string) bool {
+	pgErr, ok := err.(pgx.PgError)
+	return ok && pgErr.Code == code
+}
+
+func (b *PostgresBackend) GetCluster(clusterID string) (*discovery.Cluster, error) {
+	cluster := &discovery.Cluster{}
+	err := scanCluster(b.db.QueryRow("SELECT "+clusterFields+" FROM clusters c WHERE cluster_id = $1", clusterID), cluster)
+	if err == pgx.ErrNoRows || isPgError(err, "22P02" /*invalid input syntax*/) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
+
+// clusterFields are the columns scanned by scanCluster, selected from clusters
+// aliased as c.
+const clusterFields = "cluster_id, creator_ip, creator_user_agent, created_at, active_at, modified_index, size, secret_hash, private, (SELECT count(*) FROM instances i WHERE i.cluster_id = c.cluster_id AND " + instanceLive + ")"
+
+func scanCluster(row pgxScanner, cluster *discovery.Cluster) error {
+	var size int32
+	var instanceCount int64
+	var secretHash pgx.NullString
+	if err := row.Scan(&cluster.ID, &cluster.CreatorIP, &cluster.CreatorUserAgent, &cluster.CreatedAt, &cluster.ActiveAt, &cluster.Index, &size, &secretHash, &cluster.Private, &instanceCount); err != nil {
+		return err
+	}
+	cluster.Size = int(size)
+	cluster.SecretHash = secretHash.String
+	cluster.InstanceCount = int(instanceCount)
+	cluster.Complete = isComplete(cluster.Size, cluster.InstanceCount)
+	return nil
+}
+
+func (b *PostgresBackend) SetClusterSecret(clusterID, oldHash, newHash string) error {
+	tag, err := b.db.Exec("UPDATE clusters SET secret_hash = $3 WHERE cluster_id = $1 AND coalesce(secret_hash, '') = $2", clusterID, oldHash, newHash)
+	if isPgError(err, "22P02" /*invalid input syntax*/) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		if _, err := b.GetCluster(clusterID); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	return nil
+}
+
+func (b *PostgresBackend) GetInstance(clusterID, instanceID string) (*discovery.Instance, error) {
+	inst := &discovery.Instance{ClusterID: clusterID}
+	row := b.db.QueryRow("SELECT "+instanceFields+" FROM instances WHERE cluster_id = $1 AND instance_id = $2 AND "+instanceLive, clusterID, instanceID)
+	err := scanInstance(row, inst)
+	if err == pgx.ErrNoRows || isPgError(err, "22P02" /*invalid input syntax*/) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+func (b *PostgresBackend) DeleteInstance(clusterID, instanceID string) error {
+	tag, err := b.db.Exec("DELETE FROM instances WHERE cluster_id = $1 AND instance_id = $2 AND "+instanceLive, clusterID, instanceID)
+	if isPgError(err, "22P02" /*invalid input syntax*/) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (b *PostgresBackend) HeartbeatInstance(clusterID, instanceID string) (*discovery.Instance, error) {
+	inst := &discovery.Instance{ClusterID: clusterID}
+	row := b.db.QueryRow("WITH cluster AS (UPDATE clusters SET active_at = now() WHERE cluster_id = $1) UPDATE instances SET expires_at = CASE WHEN ttl > 0 THEN now() + ttl * interval '1 second' END WHERE cluster_id = $1 AND instance_id = $2 AND "+instanceLive+" RETURNING "+instanceFields, clusterID, instanceID)
+	err := scanInstance(row, inst)
+	if err == pgx.ErrNoRows || isPgError(err, "22P02" /*invalid input syntax*/) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+func (b *PostgresBackend) UpdateInstance(clusterID, instanceID string, update *InstanceUpdate, index int64) (*discovery.Instance, error) {
+	var flynnVersion, sshKeys, name pgx.NullString
+	if update.FlynnVersion != nil {
+		flynnVersion = pgx.NullString{String: *update.FlynnVersion, Valid: true}
+	}
+	if update.SSHPublicKeys != nil {
+		keys := *update.SSHPublicKeys
+		if keys == nil {
+			keys = []discovery.SSHPublicKey{}
+		}
+		data, _ := json.Marshal(keys)
+		sshKeys = pgx.NullString{String: string(data), Valid: true}
+	}
+	if update.Name != nil {
+		name = pgx.NullString{String: *update.Name, Valid: true}
+	}
+
+	inst := &discovery.Instance{ClusterID: clusterID}
+	row := b.db.QueryRow("UPDATE instances SET flynn_version = coalesce($3, flynn_version), ssh_public_keys = coalesce($4::json, ssh_public_keys), name = coalesce($5, name), updated_at = now() WHERE cluster_id = $1 AND instance_id = $2 AND ($6::bigint = 0 OR modified_index = $6) AND "+instanceLive+" RETURNING "+instanceFields,
+		clusterID, instanceID, flynnVersion, sshKeys, name, index)
+	err := scanInstance(row, inst)
+	if err == pgx.ErrNoRows {
+		// distinguish a missing instance from a concurrent modification
+		if _, err := b.GetInstance(clusterID, instanceID); err != nil {
+			return nil, err
+		}
+		return nil, ErrConflict
+	} else if isPgError(err, "22P02" /*invalid input syntax*/) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+func (b *PostgresBackend) DeleteExpiredInstances() ([]*discovery.Instance, error) {
+	rows, err := b.db.Query("DELETE FROM instances WHERE NOT " + instanceLive + " RETURNING cluster_id, " + instanceFields)
+	if err != nil {
+		return nil, err
+	}
+	var instances []*discovery.Instance
+	for rows.Next() {
+		inst := &discovery.Instance{}
+		if err := scanInstance(rows, inst, &inst.ClusterID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		instances = append(instances, inst)
+	}
+	return instances, rows.Err()
 }
 
+const instanceFields = "instance_id, flynn_version, ssh_public_keys, url, name, creator_ip, created_at, ttl, expires_at, modified_index, secret_hash, updated_at, created_index, peer_urls"
+
+// instanceLive is a condition matching instances that have not expired
+const instanceLive = "(expires_at IS NULL OR expires_at > now())"
+
 type pgxScanner interface {
 	Scan(...interface{}) error
 }
 
-func scanInstance(row pgxScanner, inst *Instance) error {
+// scanInstance scans the columns in instanceFields into inst. Any extra
+// destinations are scanned first, for queries that select more columns.
+func scanInstance(row pgxScanner, inst *discovery.Instance, extra ...interface{}) error {
 	if inst.CreatedAt == nil {
 		inst.CreatedAt = &time.Time{}
 	}
+	if inst.UpdatedAt == nil {
+		inst.UpdatedAt = &time.Time{}
+	}
 	var sshKeys string
-	if err := row.Scan(&inst.ID, &inst.FlynnVersion, &sshKeys, &inst.URL, &inst.Name, &inst.CreatorIP, inst.CreatedAt); err != nil {
+	var ttl int32
+	var expiresAt pgx.NullTime
+	var secretHash, peerURLs pgx.NullString
+	dest := append(extra, &inst.ID, &inst.FlynnVersion, &sshKeys, &inst.URL, &inst.Name, &inst.CreatorIP, inst.CreatedAt, &ttl, &expiresAt, &inst.Index, &secretHash, inst.UpdatedAt, &inst.CreatedIndex, &peerURLs)
+	if err := row.Scan(dest...); err != nil {
 		return err
 	}
 	if err := json.Unmarshal([]byte(sshKeys), &inst.SSHPublicKeys); err != nil {
 		return err
 	}
+	inst.PeerURLs = nil
+	if peerURLs.Valid {
+		if err := json.Unmarshal([]byte(peerURLs.String), &inst.PeerURLs); err != nil {
+			return err
+		}
+	}
+	// keys registered before fingerprints were introduced have none stored
+	setSSHFingerprints(inst.SSHPublicKeys)
+	inst.TTL = int(ttl)
+	inst.ExpiresAt = nullTime(expiresAt)
+	inst.SecretHash = secretHash.String
 	return nil
 }
 
-func (b *PostgresBackend) GetClusterInstances(clusterID string) ([]*Instance, error) {
-	rows, err := b.db.Query("SELECT instance_id, flynn_version, ssh_public_keys, url, name, creator_ip, created_at FROM instances WHERE cluster_id = $1", clusterID)
+// nullString returns s as a pgx.NullString that is NULL if s is empty.
+func nullString(s string) pgx.NullString {
+	return pgx.NullString{String: s, Valid: s != ""}
+}
+
+func nullTime(t pgx.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func (b *PostgresBackend) GetClusterInstances(clusterID string) ([]*discovery.Instance, error) {
+	rows, err := b.db.Query("SELECT "+instanceFields+" FROM instances WHERE cluster_id = $1 AND "+instanceLive+" ORDER BY created_at", clusterID)
 	if err != nil {
 		return nil, err
 	}
-	var instances []*Instance
+	var instances []*discovery.Instance
 	for rows.Next() {
-		inst := &Instance{ClusterID: clusterID}
+		inst := &discovery.Instance{ClusterID: clusterID}
 		if err := scanInstance(rows, inst); err != nil {
 			rows.Close()
 			return nil, err
 		}
 		instances = append(instances, inst)
 	}
-	return instances, rows.Err()
+	if err := rows.Err(); isPgError(err, "22P02" /*invalid input syntax*/) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+func (b *PostgresBackend) DeleteAbandonedClusters(emptyBefore, inactiveBefore time.Time, limit int, dryRun bool) ([]*discovery.Cluster, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// locking the clusters blocks instances from being added until they are
+	// deleted, the instances_modified trigger updates the cluster
+	var limitArg pgx.NullInt32
+	if limit > 0 {
+		limitArg = pgx.NullInt32{Int32: int32(limit), Valid: true}
+	}
+	rows, err := tx.Query("SELECT "+clusterFields+" FROM clusters c WHERE ($1::timestamptz IS NOT NULL AND created_at < $1 AND NOT EXISTS (SELECT 1 FROM instances i WHERE i.cluster_id = c.cluster_id AND "+instanceLive+")) OR ($2::timestamptz IS NOT NULL AND active_at < $2) ORDER BY created_at LIMIT $3 FOR UPDATE",
+		pgx.NullTime{Time: emptyBefore, Valid: !emptyBefore.IsZero()}, pgx.NullTime{Time: inactiveBefore, Valid: !inactiveBefore.IsZero()}, limitArg)
+	if err != nil {
+		return nil, err
+	}
+	var clusters []*discovery.Cluster
+	var ids []string
+	for rows.Next() {
+		cluster := &discovery.Cluster{}
+		if err := scanCluster(rows, cluster); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		clusters = append(clusters, cluster)
+		ids = append(ids, cluster.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if dryRun || len(clusters) == 0 {
+		return clusters, nil
+	}
+
+	// instances must be deleted before events as the instances_modified
+	// trigger records their deletion
+	for _, table := range []string{"instances", "instance_events", "clusters"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE cluster_id = ANY($1::text[]::uuid[])", ids); err != nil {
+			return nil, err
+		}
+	}
+	return clusters, tx.Commit()
+}
+
+func (b *PostgresBackend) GetEvents(clusterID string, afterIndex int64) ([]*Event, error) {
+	rows, err := b.db.Query("SELECT event_id, type, instance, created_at FROM instance_events WHERE cluster_id = $1 AND event_id > $2 ORDER BY event_id", clusterID, afterIndex)
+	if err != nil {
+		return nil, err
+	}
+	var events []*Event
+	for rows.Next() {
+		event := &Event{ClusterID: clusterID}
+		var typ, inst string
+		if err := rows.Scan(&event.ID, &typ, &inst, &event.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		event.Type = EventType(typ)
+		if err := json.Unmarshal([]byte(inst), &event.Instance); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if event.Instance != nil {
+			setSSHFingerprints(event.Instance.SSHPublicKeys)
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); isPgError(err, "22P02" /*invalid input syntax*/) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (b *PostgresBackend) SubscribeCluster(clusterID string) (<-chan int64, func()) {
+	return b.notifier.subscribe(clusterID)
+}
+
+// listen dispatches the notifications sent by the instances_modified trigger
+// to subscribers until the backend is closed.
+func (b *PostgresBackend) listen() {
+	defer close(b.done)
+	for {
+		err := b.listenConn()
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+		log.Error("error listening for instance notifications", "err", err)
+		select {
+		case <-b.stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (b *PostgresBackend) listenConn() error {
+	conn, err := b.db.Acquire()
+	if err != nil {
+		return err
+	}
+	defer b.db.Release(conn)
+	if err := conn.Listen("instances"); err != nil {
+		return err
+	}
+	defer conn.Exec("UNLISTEN instances")
+
+	for {
+		select {
+		case <-b.stop:
+			return nil
+		default:
+		}
+		// wait with a short timeout so that Close doesn't block for long
+		n, err := conn.WaitForNotification(time.Second)
+		if err == pgx.ErrNotificationTimeout {
+			continue
+		} else if err != nil {
+			return err
+		}
+		// the payload is "<cluster_id>:<modified_index>"
+		parts := strings.SplitN(n.Payload, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		index, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		b.notifier.notify(parts[0], index)
+	}
 }
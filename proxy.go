@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseTrustedProxies parses a comma separated list of CIDRs or IP addresses
+// of proxies whose forwarding headers are trusted.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", field)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(trusted []*net.IPNet, ip net.IP) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The forwarding headers clientIP reads. Only one of them is used, as proxies
+// only append to the header they set and pass the other through, so a client
+// could set it to any address.
+const (
+	forwardedHeaderXFF       = "xff"
+	forwardedHeaderForwarded = "forwarded"
+)
+
+// clientIP returns the IP address of the client that sent req. The
+// forwarding header, X-Forwarded-For or the RFC 7239 Forwarded header
+// depending on header, is only used if the request comes from a trusted
+// proxy, in which case the chain of forwarded addresses is walked from the
+// right, skipping trusted proxies, up to the first untrusted address.
+func clientIP(req *http.Request, trusted []*net.IPNet, header string) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(trusted, ip) {
+		return ip
+	}
+
+	var chain []string
+	if header == forwardedHeaderForwarded {
+		chain = parseForwarded(strings.Join(req.Header["Forwarded"], ","))
+	} else {
+		for _, value := range req.Header["X-Forwarded-For"] {
+			for _, addr := range strings.Split(value, ",") {
+				chain = append(chain, strings.TrimSpace(addr))
+			}
+		}
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := parseForwardedIP(chain[i])
+		if hop == nil {
+			// an unknown or obfuscated address can't be traced any
+			// further, so the last trusted proxy is the client
+			return ip
+		}
+		ip = hop
+		if !isTrustedProxy(trusted, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// parseForwarded returns the for parameters of the elements of an RFC 7239
+// Forwarded header value, which lists the forwarded addresses from the client
+// to the last proxy.
+func parseForwarded(value string) []string {
+	var addrs []string
+	for _, element := range splitQuoted(value, ',') {
+		var addr string
+		for _, pair := range splitQuoted(element, ';') {
+			i := strings.Index(pair, "=")
+			if i < 0 || !strings.EqualFold(strings.TrimSpace(pair[:i]), "for") {
+				continue
+			}
+			addr = strings.TrimSpace(pair[i+1:])
+			if unquoted, err := strconv.Unquote(addr); err == nil {
+				addr = unquoted
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// splitQuoted splits s at sep outside of quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	var quoted, escaped bool
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseForwardedIP parses a forwarded address, which is either an IP address
+// or an IP address and port, with IPv6 addresses in brackets if they have a
+// port. It returns nil for obfuscated identifiers and "unknown".
+func parseForwardedIP(addr string) net.IP {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+}
+
+// proxyProtocolTimeout is the maximum time to wait for a PROXY protocol
+// header after a connection is accepted.
+const proxyProtocolTimeout = 10 * time.Second
+
+// proxyProtocolListener accepts connections with a PROXY protocol v1 or v2
+// header from trusted proxies, and reports the client address from the header
+// as their remote address. Connections from other addresses, or without a
+// header, are passed through unchanged.
+type proxyProtocolListener struct {
+	net.Listener
+	Trusted []*net.IPNet
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !isTrustedProxy(l.Trusted, addr.IP) {
+		return conn, nil
+	}
+	// the header is read by the connection's goroutine so that a slow proxy
+	// doesn't block accepting other connections
+	return &proxyProtocolConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		c.remoteAddr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// readProxyHeader reads a PROXY protocol header from r if there is one, and
+// returns the source address it contains. It returns a nil address if there
+// is no header or it does not contain an address.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if prefix, err := r.Peek(len(proxyV1Prefix)); err == nil && bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyHeaderV1(r)
+	}
+	if prefix, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	return nil, nil
+}
+
+// readProxyHeaderV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324
+// 443\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidProxyHeader
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyHeaderV2 reads a binary header, which is the signature followed by
+// the version and command, the address family and protocol, the length of the
+// addresses and the addresses.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errInvalidProxyHeader
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, err
+	}
+	if header[12]&0xf == 0 {
+		// LOCAL command, the connection was made by the proxy itself
+		return nil, nil
+	}
+
+	var ipLen int
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(addrs) < 2*ipLen+4 {
+		return nil, errInvalidProxyHeader
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, addrs[:ipLen])
+	port := binary.BigEndian.Uint16(addrs[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
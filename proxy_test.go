@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		header     string
+		xff        []string
+		forwarded  []string
+		expected   string
+	}{
+		{name: "direct", remoteAddr: "203.0.113.1:1234", expected: "203.0.113.1"},
+		{name: "untrusted xff", remoteAddr: "203.0.113.1:1234", xff: []string{"198.51.100.1"}, expected: "203.0.113.1"},
+		{name: "trusted without header", remoteAddr: "10.0.0.1:1234", expected: "10.0.0.1"},
+		{name: "xff", remoteAddr: "10.0.0.1:1234", xff: []string{"198.51.100.1"}, expected: "198.51.100.1"},
+		{name: "xff spoofed by client", remoteAddr: "10.0.0.1:1234", xff: []string{"1.2.3.4, 198.51.100.1"}, expected: "198.51.100.1"},
+		{name: "xff trusted hops", remoteAddr: "10.0.0.1:1234", xff: []string{"198.51.100.1, 192.168.1.1", "10.0.0.2"}, expected: "198.51.100.1"},
+		{name: "xff all trusted", remoteAddr: "10.0.0.1:1234", xff: []string{"10.0.0.3, 10.0.0.2"}, expected: "10.0.0.3"},
+		{name: "xff garbage", remoteAddr: "10.0.0.1:1234", xff: []string{"unknown"}, expected: "10.0.0.1"},
+		{name: "xff ignores forwarded", remoteAddr: "10.0.0.1:1234", xff: []string{"198.51.100.1"}, forwarded: []string{"for=1.2.3.4"}, expected: "198.51.100.1"},
+		{name: "xff without xff header", remoteAddr: "10.0.0.1:1234", forwarded: []string{"for=1.2.3.4"}, expected: "10.0.0.1"},
+		{name: "forwarded", remoteAddr: "10.0.0.1:1234", header: "forwarded", forwarded: []string{"for=198.51.100.1;proto=https"}, expected: "198.51.100.1"},
+		{name: "forwarded ignores xff", remoteAddr: "10.0.0.1:1234", header: "forwarded", xff: []string{"1.2.3.4"}, forwarded: []string{"for=198.51.100.1"}, expected: "198.51.100.1"},
+		{name: "forwarded without forwarded header", remoteAddr: "10.0.0.1:1234", header: "forwarded", xff: []string{"1.2.3.4"}, expected: "10.0.0.1"},
+		{name: "forwarded ipv6", remoteAddr: "[fd00::1]:1234", header: "forwarded", forwarded: []string{`for="[2001:db8::1]:4711"`}, expected: "2001:db8::1"},
+		{name: "forwarded trusted hops", remoteAddr: "10.0.0.1:1234", header: "forwarded", forwarded: []string{"for=198.51.100.1, for=192.168.1.1", "for=10.0.0.2"}, expected: "198.51.100.1"},
+		{name: "forwarded obfuscated", remoteAddr: "10.0.0.1:1234", header: "forwarded", forwarded: []string{"for=_hidden, for=10.0.0.2"}, expected: "10.0.0.2"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = test.remoteAddr
+			req.Header["X-Forwarded-For"] = test.xff
+			req.Header["Forwarded"] = test.forwarded
+			header := test.header
+			if header == "" {
+				header = forwardedHeaderXFF
+			}
+			if ip := clientIP(req, trusted, header); ip.String() != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, ip)
+			}
+		})
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected []string
+	}{
+		{"for=192.0.2.60", []string{"192.0.2.60"}},
+		{"for=192.0.2.43, for=198.51.100.17", []string{"192.0.2.43", "198.51.100.17"}},
+		{"For=\"[2001:db8:cafe::17]:4711\"", []string{"[2001:db8:cafe::17]:4711"}},
+		{"for=192.0.2.60;proto=http;by=203.0.113.43", []string{"192.0.2.60"}},
+		{"proto=https;for=192.0.2.60", []string{"192.0.2.60"}},
+		{`for="_gazonk"`, []string{"_gazonk"}},
+		{`for=unknown, for="192.0.2.1;x,y"`, []string{"unknown", "192.0.2.1;x,y"}},
+		{"proto=https", []string{""}},
+	} {
+		if addrs := parseForwarded(test.value); !reflect.DeepEqual(addrs, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.value, test.expected, addrs)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1,,2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strs []string
+	for _, n := range nets {
+		strs = append(strs, n.String())
+	}
+	if expected := []string{"10.0.0.0/8", "192.168.1.1/32", "2001:db8::1/128"}; !reflect.DeepEqual(strs, expected) {
+		t.Errorf("expected %q, got %q", expected, strs)
+	}
+	for _, s := range []string{"10.0.0.0/33", "example.com"} {
+		if _, err := parseTrustedProxies(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+// proxyHeaderV2 returns a PROXY protocol v2 header with the given command,
+// address family and addresses.
+func proxyHeaderV2(command, family byte, addrs []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(0x20 | command)
+	buf.WriteByte(family<<4 | 1) // STREAM
+	binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
+
+func proxyAddrsV2(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	var buf bytes.Buffer
+	buf.Write(src)
+	buf.Write(dst)
+	binary.Write(&buf, binary.BigEndian, srcPort)
+	binary.Write(&buf, binary.BigEndian, dstPort)
+	return buf.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := proxyAddrsV2(net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4(), 56324, 443)
+	ipv6 := proxyAddrsV2(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 56324, 443)
+
+	for _, test := range []struct {
+		name     string
+		data     []byte
+		expected string // empty if there is no address
+		err      bool
+	}{
+		{name: "no header", data: []byte("GET / HTTP/1.1\r\n")},
+		{name: "v1 tcp4", data: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"), expected: "192.0.2.1:56324"},
+		{name: "v1 tcp6", data: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), expected: "[2001:db8::1]:56324"},
+		{name: "v1 unknown", data: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 without crlf", data: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n"), err: true},
+		{name: "v1 too long", data: []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), err: true},
+		{name: "v1 invalid ip", data: []byte("PROXY TCP4 192.0.2 192.0.2.2 56324 443\r\n"), err: true},
+		{name: "v1 invalid port", data: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n"), err: true},
+		{name: "v1 invalid protocol", data: []byte("PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n"), err: true},
+		{name: "v1 truncated", data: []byte("PROXY TCP4 192.0.2.1"), err: true},
+		{name: "v2 ipv4", data: proxyHeaderV2(1, 1, ipv4), expected: "192.0.2.1:56324"},
+		{name: "v2 ipv6", data: proxyHeaderV2(1, 2, ipv6), expected: "[2001:db8::1]:56324"},
+		{name: "v2 local", data: proxyHeaderV2(0, 1, ipv4)},
+		{name: "v2 unix", data: proxyHeaderV2(1, 3, make([]byte, 216))},
+		{name: "v2 tlvs", data: proxyHeaderV2(1, 1, append(ipv4, 0x04, 0x00, 0x01, 0x00)), expected: "192.0.2.1:56324"},
+		{name: "v2 short addresses", data: proxyHeaderV2(1, 2, ipv4), err: true},
+		{name: "v2 truncated", data: proxyHeaderV2(1, 1, ipv4)[:20], err: true},
+		{name: "v2 invalid version", data: append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0), err: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := test.data
+			if !test.err {
+				data = append(data, "GET / HTTP/1.1\r\n"...)
+			}
+			r := bufio.NewReader(bytes.NewReader(data))
+			addr, err := readProxyHeader(r)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.expected == "" {
+				if addr != nil {
+					t.Errorf("expected no address, got %s", addr)
+				}
+			} else if addr == nil || addr.String() != test.expected {
+				t.Errorf("expected %s, got %v", test.expected, addr)
+			}
+			// the request following the header is left unread
+			if rest, _ := ioutil.ReadAll(r); !bytes.HasSuffix(rest, []byte("GET / HTTP/1.1\r\n")) {
+				t.Errorf("expected the request to follow the header, got %q", rest)
+			}
+		})
+	}
+}
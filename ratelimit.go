@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/jackc/pgx"
+	log "github.com/flynn/flynn-discovery/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+)
+
+// RateLimit is a token bucket that holds up to Burst tokens and is refilled
+// at Rate tokens per second. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// take refills a bucket holding tokens for elapsed and takes a token from
+// it. It returns the tokens left and, if the bucket was empty, the time until
+// a token is available.
+func (l RateLimit) take(tokens float64, elapsed time.Duration) (float64, time.Duration) {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	tokens = math.Min(float64(l.Burst), tokens+elapsed.Seconds()*l.Rate)
+	if tokens >= 1 {
+		return tokens - 1, 0
+	}
+	return tokens, time.Duration((1 - tokens) / l.Rate * float64(time.Second))
+}
+
+// refillTime returns how long it takes to refill a bucket holding tokens.
+func (l RateLimit) refillTime(tokens float64) time.Duration {
+	return time.Duration((float64(l.Burst) - tokens) / l.Rate * float64(time.Second))
+}
+
+// String formats the limit as accepted by Set.
+func (l *RateLimit) String() string {
+	if !l.enabled() {
+		return "0"
+	}
+	period := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	return fmt.Sprintf("%d/%s", l.Burst, period)
+}
+
+// Set parses a limit of the form "N/DURATION", which allows bursts of N
+// requests and refills the bucket over DURATION, or "0" to disable it. It
+// implements flag.Value.
+func (l *RateLimit) Set(s string) error {
+	if s == "0" || s == "" {
+		*l = RateLimit{}
+		return nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid rate limit %q, expected N/DURATION", s)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid rate limit %q, expected N/DURATION", s)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return fmt.Errorf("invalid rate limit %q, expected N/DURATION", s)
+	}
+	*l = RateLimit{Rate: float64(n) / period.Seconds(), Burst: n}
+	return nil
+}
+
+// RateLimiter keeps the token buckets of rate limited clients.
+type RateLimiter interface {
+	// Take takes a token from the bucket identified by key, which is limited
+	// by limit. If the bucket is empty it returns the time until a token is
+	// available.
+	Take(key string, limit RateLimit) (time.Duration, error)
+}
+
+// pruneInterval is how often rate limiters remove buckets that are full, as
+// they are equivalent to no bucket at all.
+const pruneInterval = time.Minute
+
+// NewMemoryRateLimiter returns a RateLimiter that keeps the buckets in
+// process memory, so the limits apply to each server separately.
+func NewMemoryRateLimiter() RateLimiter {
+	return &memoryRateLimiter{buckets: make(map[string]*bucket)}
+}
+
+type memoryRateLimiter struct {
+	mtx       sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+func (r *memoryRateLimiter) Take(key string, limit RateLimit) (time.Duration, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastPrune) > pruneInterval {
+		for k, b := range r.buckets {
+			if now.After(b.fullAt) {
+				delete(r.buckets, k)
+			}
+		}
+		r.lastPrune = now
+	}
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updatedAt: now}
+		r.buckets[key] = b
+	}
+	var wait time.Duration
+	b.tokens, wait = limit.take(b.tokens, now.Sub(b.updatedAt))
+	b.updatedAt = now
+	b.fullAt = now.Add(limit.refillTime(b.tokens))
+	return wait, nil
+}
+
+// NewPostgresRateLimiter returns a RateLimiter that keeps the buckets in the
+// rate_limits table, so that all servers using the database share the limits.
+func NewPostgresRateLimiter(db *pgx.ConnPool) RateLimiter {
+	return &postgresRateLimiter{db: db}
+}
+
+type postgresRateLimiter struct {
+	db *pgx.ConnPool
+
+	mtx       sync.Mutex
+	lastPrune time.Time
+}
+
+func (r *postgresRateLimiter) Take(key string, limit RateLimit) (time.Duration, error) {
+	r.mtx.Lock()
+	if time.Since(r.lastPrune) > pruneInterval {
+		r.lastPrune = time.Now()
+		go r.prune()
+	}
+	r.mtx.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO rate_limits (key, tokens) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING", key, float64(limit.Burst)); err != nil {
+		return 0, err
+	}
+	var tokens, elapsed float64
+	if err := tx.QueryRow("SELECT tokens, extract(epoch FROM now() - updated_at)::float8 FROM rate_limits WHERE key = $1 FOR UPDATE", key).Scan(&tokens, &elapsed); err != nil {
+		return 0, err
+	}
+	tokens, wait := limit.take(tokens, time.Duration(elapsed*float64(time.Second)))
+	if _, err := tx.Exec("UPDATE rate_limits SET tokens = $2, updated_at = now(), full_at = now() + $3::float8 * interval '1 second' WHERE key = $1",
+		key, tokens, limit.refillTime(tokens).Seconds()); err != nil {
+		return 0, err
+	}
+	return wait, tx.Commit()
+}
+
+func (r *postgresRateLimiter) prune() {
+	if _, err := r.db.Exec("DELETE FROM rate_limits WHERE full_at < now()"); err != nil {
+		log.Error("error pruning rate limits", "err", err)
+	}
+}
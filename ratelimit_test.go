@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/flynn/flynn/pkg/random"
+)
+
+func TestRateLimitTake(t *testing.T) {
+	// 10 tokens per minute
+	limit := RateLimit{Rate: 10.0 / 60, Burst: 10}
+	for _, test := range []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		left    float64
+		wait    time.Duration
+	}{
+		{"full", 10, 0, 9, 0},
+		{"refilled", 5, 30 * time.Second, 9, 0},
+		{"refill capped at burst", 5, time.Hour, 9, 0},
+		{"last token", 1, 0, 0, 0},
+		{"empty", 0, 0, 0, 6 * time.Second},
+		{"partially refilled", 0, 3 * time.Second, 0.5, 3 * time.Second},
+		{"negative elapsed", 0, -time.Minute, 0, 6 * time.Second},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			left, wait := limit.take(test.tokens, test.elapsed)
+			if math.Abs(left-test.left) > 1e-9 {
+				t.Errorf("expected %v tokens left, got %v", test.left, left)
+			}
+			if d := wait - test.wait; d < -time.Millisecond || d > time.Millisecond {
+				t.Errorf("expected to wait %s, got %s", test.wait, wait)
+			}
+		})
+	}
+}
+
+func TestRateLimitRefillTime(t *testing.T) {
+	limit := RateLimit{Rate: 10.0 / 60, Burst: 10}
+	for tokens, expected := range map[float64]time.Duration{
+		10:  0,
+		9:   6 * time.Second,
+		0:   time.Minute,
+		2.5: 45 * time.Second,
+	} {
+		if d := limit.refillTime(tokens) - expected; d < -time.Millisecond || d > time.Millisecond {
+			t.Errorf("expected refill time of %v tokens to be %s, got %s", tokens, expected, limit.refillTime(tokens))
+		}
+	}
+}
+
+func TestRateLimitSet(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected RateLimit
+		err      bool
+	}{
+		{value: "30/1h", expected: RateLimit{Rate: 30.0 / 3600, Burst: 30}},
+		{value: "5/10s", expected: RateLimit{Rate: 0.5, Burst: 5}},
+		{value: "0", expected: RateLimit{}},
+		{value: "", expected: RateLimit{}},
+		{value: "30", err: true},
+		{value: "x/1h", err: true},
+		{value: "-1/1h", err: true},
+		{value: "30/x", err: true},
+		{value: "30/0s", err: true},
+		{value: "30/-1h", err: true},
+	} {
+		t.Run(test.value, func(t *testing.T) {
+			limit := RateLimit{Rate: 1, Burst: 1}
+			err := limit.Set(test.value)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", limit)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(limit.Rate-test.expected.Rate) > 1e-12 || limit.Burst != test.expected.Burst {
+				t.Errorf("expected %+v, got %+v", test.expected, limit)
+			}
+			if test.value != "" {
+				var parsed RateLimit
+				if err := parsed.Set(limit.String()); err != nil || math.Abs(parsed.Rate-limit.Rate) > 1e-12 || parsed.Burst != limit.Burst {
+					t.Errorf("expected %q to round trip, got %+v (%v)", limit.String(), parsed, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	testRateLimiter(t, NewMemoryRateLimiter())
+}
+
+func TestMemoryRateLimiterPrune(t *testing.T) {
+	r := NewMemoryRateLimiter().(*memoryRateLimiter)
+	limit := RateLimit{Rate: 1.0 / 60, Burst: 2}
+	for _, key := range []string{"full", "refilling"} {
+		if _, err := r.Take(key, limit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the full bucket was refilled a while ago, and it's time to prune
+	r.buckets["full"].fullAt = time.Now().Add(-time.Second)
+	r.lastPrune = time.Now().Add(-2 * pruneInterval)
+	if _, err := r.Take("new", limit); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.buckets["full"]; ok {
+		t.Error("expected the full bucket to be pruned")
+	}
+	if _, ok := r.buckets["refilling"]; !ok {
+		t.Error("expected the refilling bucket to be kept")
+	}
+
+	// buckets are only pruned every pruneInterval
+	r.buckets["refilling"].fullAt = time.Now().Add(-time.Second)
+	if _, err := r.Take("new", limit); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.buckets["refilling"]; !ok {
+		t.Error("expected buckets not to be pruned again before pruneInterval")
+	}
+}
+
+func TestPostgresRateLimiter(t *testing.T) {
+	db := testPostgresDB(t)
+	defer db.Close()
+	testRateLimiter(t, NewPostgresRateLimiter(db))
+}
+
+// testRateLimiter checks that a RateLimiter allows bursts and then limits
+// requests until the bucket is refilled.
+func testRateLimiter(t *testing.T, r RateLimiter) {
+	key := "test:" + random.Hex(8)
+	limit := RateLimit{Rate: 1.0 / 60, Burst: 3}
+	for i := 0; i < limit.Burst; i++ {
+		wait, err := r.Take(key, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != 0 {
+			t.Fatalf("expected request %d to be allowed, got wait %s", i, wait)
+		}
+	}
+	wait, err := r.Take(key, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait < 55*time.Second || wait > time.Minute {
+		t.Errorf("expected to wait about a minute, got %s", wait)
+	}
+	if wait, err := r.Take(key+":other", limit); err != nil || wait != 0 {
+		t.Errorf("expected other keys not to be limited, got wait %s (%v)", wait, err)
+	}
+}
+
+func TestRateLimitedRequests(t *testing.T) {
+	s, cluster := newTestServer(t)
+	s.ClusterLimit = RateLimit{Rate: 1.0 / 3600, Burst: 1}
+	s.InstanceLimit = RateLimit{Rate: 2.0 / 3600, Burst: 2}
+
+	for _, test := range []struct {
+		name    string
+		request func(i int) *httptest.ResponseRecorder
+		allowed int
+	}{
+		{
+			name: "clusters",
+			request: func(int) *httptest.ResponseRecorder {
+				return testRequest(s, "POST", "/clusters", "", nil)
+			},
+			allowed: 1,
+		},
+		{
+			name: "instances",
+			request: func(i int) *httptest.ResponseRecorder {
+				body := map[string]interface{}{"data": map[string]interface{}{"url": fmt.Sprintf("http://10.0.0.%d:1111", i)}}
+				return testRequest(s, "POST", "/clusters/"+cluster.ID+"/instances", cluster.Secret, body)
+			},
+			allowed: 2,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < test.allowed; i++ {
+				if res := test.request(i); res.Code != 201 {
+					t.Fatalf("expected request %d to succeed, got %d: %s", i, res.Code, res.Body)
+				}
+			}
+			res := test.request(test.allowed)
+			if res.Code != 429 {
+				t.Fatalf("expected status 429, got %d: %s", res.Code, res.Body)
+			}
+			var jsonErr httphelper.JSONError
+			decodeTestResponse(t, res, &jsonErr)
+			if jsonErr.Code != rateLimitedErrorCode {
+				t.Errorf("expected code %q, got %q", rateLimitedErrorCode, jsonErr.Code)
+			}
+			retryAfter, err := strconv.Atoi(res.Header().Get("Retry-After"))
+			if err != nil || retryAfter <= 0 || retryAfter > 3600 {
+				t.Errorf("expected Retry-After to be between 1 and 3600 seconds, got %q", res.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestMaxClusterInstances(t *testing.T) {
+	s, cluster := newTestServer(t)
+	s.MaxClusterInstances = 1
+	register := func(url string) *httptest.ResponseRecorder {
+		body := map[string]interface{}{"data": map[string]interface{}{"url": url}}
+		return testRequest(s, "POST", "/clusters/"+cluster.ID+"/instances", cluster.Secret, body)
+	}
+
+	if res := register("http://10.0.0.1:1111"); res.Code != 201 {
+		t.Fatalf("expected status 201, got %d: %s", res.Code, res.Body)
+	}
+	// a duplicate is still reported as such
+	if res := register("http://10.0.0.1:1111"); res.Code != 409 {
+		t.Errorf("expected status 409 registering a duplicate, got %d: %s", res.Code, res.Body)
+	}
+	res := register("http://10.0.0.2:1111")
+	if res.Code != 429 {
+		t.Fatalf("expected status 429, got %d: %s", res.Code, res.Body)
+	}
+	if res.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected Retry-After 60, got %q", res.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/flynn/flynn-discovery/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+)
+
+// reapExpiredInstances deletes expired instances from backend every interval.
+// It never returns.
+func reapExpiredInstances(backend StorageBackend, interval time.Duration) {
+	for range time.Tick(interval) {
+		expired, err := backend.DeleteExpiredInstances()
+		countStorageError("DeleteExpiredInstances", err)
+		if err != nil {
+			log.Error("error reaping expired instances", "err", err)
+			continue
+		}
+		instancesExpired.add(float64(len(expired)))
+		if len(expired) > 0 {
+			log.Info("reaped expired instances", "count", len(expired))
+		}
+	}
+}
@@ -1,22 +1,141 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/jackc/pgx"
+	log "github.com/flynn/flynn-discovery/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
 )
 
-func main() {
-	dbConfig, err := pgx.ParseURI(os.Getenv("DATABASE_URL"))
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	port := flags.String("port", os.Getenv("PORT"), "port to listen on")
+	url := flags.String("url", os.Getenv("URL"), "external URL of the server, used in Location headers")
+	migrate := flags.Bool("migrate", true, "apply pending database migrations before serving")
+	memory := flags.Bool("memory", false, "keep all data in memory instead of the database at DATABASE_URL, it is lost on restart")
+	var gc gcPolicy
+	flags.DurationVar(&gc.EmptyAfter, "gc-empty-after", 0, "delete clusters without instances after this long (0 disables)")
+	flags.DurationVar(&gc.InactiveAfter, "gc-inactive-after", 0, "delete clusters without activity for this long (0 disables)")
+	flags.IntVar(&gc.BatchSize, "gc-batch-size", 100, "maximum number of clusters to delete at once")
+	flags.BoolVar(&gc.DryRun, "gc-dry-run", false, "log abandoned clusters instead of deleting them")
+	gcInterval := flags.Duration("gc-interval", time.Hour, "how often to look for abandoned clusters")
+	healthTimeout := flags.Duration("health-timeout", 5*time.Second, "maximum time the readiness check waits for the database")
+	clusterLimit := RateLimit{Rate: 30 / time.Hour.Seconds(), Burst: 30}
+	flags.Var(&clusterLimit, "cluster-rate-limit", "clusters that may be created per IP, as N/DURATION (0 disables)")
+	instanceLimit := RateLimit{Rate: 100 / time.Hour.Seconds(), Burst: 100}
+	flags.Var(&instanceLimit, "instance-rate-limit", "instances that may be registered per IP, as N/DURATION (0 disables)")
+	maxClusterInstances := flags.Int("max-cluster-instances", 500, "maximum number of instances in a cluster (0 is unlimited)")
+	sharedRateLimits := flags.Bool("shared-rate-limits", false, "keep rate limits in the database so that all servers share them")
+	trustedProxies := flags.String("trusted-proxies", os.Getenv("TRUSTED_PROXIES"), "comma separated CIDRs of proxies whose forwarding headers are trusted")
+	forwardedHeader := flags.String("forwarded-header", "xff", "forwarding header set by the trusted proxies, xff for X-Forwarded-For or forwarded for Forwarded")
+	proxyProtocol := flags.Bool("proxy-protocol", false, "accept PROXY protocol headers from trusted proxies")
+	dnsAddr := flags.String("dns-addr", "", "address to serve DNS queries for cluster instances on, such as :53 (disabled if empty)")
+	dnsZone := flags.String("dns-zone", "discovery.local.", "DNS zone of the clusters")
+	dnsTTL := flags.Duration("dns-ttl", 10*time.Second, "TTL of DNS records, instances are cached for as long")
+	logLevel := flags.String("log-level", "info", "minimum level of log messages (debug, info, warn, error or crit)")
+	logFormat := flags.String("log-format", "logfmt", "format of log messages (logfmt or json)")
+	drainTimeout := flags.Duration("drain-timeout", 10*time.Second, "how long to keep serving requests after SIGTERM while reporting not ready")
+	flags.Parse(args)
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		return err
+	}
+	trusted, err := parseTrustedProxies(*trustedProxies)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if *forwardedHeader != forwardedHeaderXFF && *forwardedHeader != forwardedHeaderForwarded {
+		return fmt.Errorf("invalid -forwarded-header %q, expected xff or forwarded", *forwardedHeader)
+	}
+	if len(trusted) == 0 && (clusterLimit.enabled() || instanceLimit.enabled()) {
+		log.Warn("rate limits are enabled without -trusted-proxies, all clients behind a proxy share the limits of its IP")
+	}
+
+	var backend StorageBackend
+	limiter := NewMemoryRateLimiter()
+	if !*memory {
+		if os.Getenv("DATABASE_URL") == "" {
+			return errors.New("DATABASE_URL is not set, pass -memory to keep all data in memory instead")
+		}
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		if *migrate {
+			if err := migrateDB(db, false, os.Stderr); err != nil {
+				return err
+			}
+		}
+		backend = NewPostgresBackend(db)
+		if *sharedRateLimits {
+			limiter = NewPostgresRateLimiter(db)
+		}
+	} else if *sharedRateLimits {
+		return errors.New("-shared-rate-limits can't be used with -memory")
+	} else {
+		log.Warn("using in-memory storage, all data is lost on restart")
+		backend = NewMemoryBackend()
+	}
+
+	go reapExpiredInstances(backend, time.Minute)
+	if gc.enabled() {
+		go collectGarbage(backend, gc, *gcInterval)
+	}
+
+	srv := NewServer(*url, backend)
+	srv.HealthTimeout = *healthTimeout
+	srv.RateLimiter = limiter
+	srv.ClusterLimit = clusterLimit
+	srv.InstanceLimit = instanceLimit
+	srv.MaxClusterInstances = *maxClusterInstances
+	srv.TrustedProxies = trusted
+	srv.ForwardedHeader = *forwardedHeader
+	go drainOnSignal(srv, *drainTimeout)
+
+	if *dnsAddr != "" {
+		if err := newDNSServer(backend, *dnsZone, *dnsTTL).Start(*dnsAddr); err != nil {
+			return err
+		}
 	}
-	db, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: dbConfig})
+
+	l, err := net.Listen("tcp", ":"+*port)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if *proxyProtocol {
+		l = &proxyProtocolListener{Listener: l, Trusted: trusted}
 	}
+	return http.Serve(l, srv)
+}
 
-	log.Fatal(http.ListenAndServe(":"+os.Getenv("PORT"), NewServer(os.Getenv("URL"), NewPostgresBackend(db))))
+// drainOnSignal waits for SIGTERM or SIGINT, then marks srv as draining so
+// that load balancers stop sending it traffic, and exits after timeout.
+func drainOnSignal(srv *Server, timeout time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-ch
+	log.Info("draining", "signal", sig, "timeout", timeout)
+	srv.Drain()
+	time.Sleep(timeout)
+	os.Exit(0)
+}
+
+// openDB connects to the database at DATABASE_URL.
+func openDB() (*pgx.ConnPool, error) {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		return nil, errors.New("DATABASE_URL is not set")
+	}
+	dbConfig, err := pgx.ParseURI(dbURL)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: dbConfig})
 }
@@ -3,35 +3,114 @@ package main
 import (
 	"errors"
 	"time"
+
+	"github.com/flynn/flynn-discovery/discovery"
 )
 
-type Cluster struct {
-	ID               string
-	CreatorIP        string
-	CreatorUserAgent string
-	CreatedAt        time.Time
+type EventType string
+
+const (
+	EventInstanceCreated EventType = "instance_created"
+	EventInstanceUpdated EventType = "instance_updated"
+	EventInstanceDeleted EventType = "instance_deleted"
+	EventInstanceExpired EventType = "instance_expired"
+)
+
+// Event records a change to the membership of a cluster. The ID of an event
+// is the cluster's modification index after the change.
+type Event struct {
+	ID        int64               `json:"id"`
+	ClusterID string              `json:"cluster_id"`
+	Type      EventType           `json:"type"`
+	Instance  *discovery.Instance `json:"instance"`
+	CreatedAt time.Time           `json:"created_at"`
 }
 
-type Instance struct {
-	ID            string         `json:"id"`
-	ClusterID     string         `json:"cluster_id"`
-	FlynnVersion  string         `json:"flynn_version,omitempty"`
-	SSHPublicKeys []SSHPublicKey `json:"ssh_public_keys,omitempty"`
-	URL           string         `json:"url,omitempty"`
-	Name          string         `json:"name,omitempty"`
-	CreatorIP     string         `json:"-"`
-	CreatedAt     *time.Time     `json:"created_at,omitempty"`
+var (
+	ErrExists   = errors.New("object exists")
+	ErrNotFound = errors.New("object not found")
+
+	// ErrConflict is returned when an update is based on a stale version of
+	// an object.
+	ErrConflict = errors.New("object was modified concurrently")
+
+	// ErrClusterFull is returned when registering an instance with a cluster
+	// that already has as many instances as its expected size.
+	ErrClusterFull = errors.New("cluster is full")
+)
+
+// isComplete reports whether a cluster with the given expected size and
+// number of instances is complete.
+func isComplete(size, instanceCount int) bool {
+	return size > 0 && instanceCount >= size
 }
 
-type SSHPublicKey struct {
-	Type string `json:"type"`
-	Data []byte `json:"data"`
+// InstanceUpdate holds the new values of the mutable fields of an instance.
+// Nil fields are left unchanged.
+type InstanceUpdate struct {
+	FlynnVersion  *string                   `json:"flynn_version"`
+	SSHPublicKeys *[]discovery.SSHPublicKey `json:"ssh_public_keys"`
+	Name          *string                   `json:"name"`
 }
 
-var ErrExists = errors.New("object exists")
+// apply sets the fields of inst that are set in u.
+func (u *InstanceUpdate) apply(inst *discovery.Instance) {
+	if u.FlynnVersion != nil {
+		inst.FlynnVersion = *u.FlynnVersion
+	}
+	if u.SSHPublicKeys != nil {
+		inst.SSHPublicKeys = *u.SSHPublicKeys
+	}
+	if u.Name != nil {
+		inst.Name = *u.Name
+	}
+}
 
 type StorageBackend interface {
-	CreateCluster(*Cluster) error
-	CreateInstance(instance *Instance) error
-	GetClusterInstances(clusterID string) ([]*Instance, error)
+	CreateCluster(*discovery.Cluster) error
+
+	// CreateInstance registers the instance with its cluster and returns
+	// ErrExists if an instance with the same URL, or the same ID if it is
+	// set, already exists. The instance ID is generated unless it is set.
+	CreateInstance(instance *discovery.Instance) error
+	GetClusterInstances(clusterID string) ([]*discovery.Instance, error)
+	GetCluster(clusterID string) (*discovery.Cluster, error)
+
+	// SetClusterSecret replaces the cluster's secret hash with newHash if it
+	// is currently oldHash, and returns ErrConflict otherwise.
+	SetClusterSecret(clusterID, oldHash, newHash string) error
+
+	GetInstance(clusterID, instanceID string) (*discovery.Instance, error)
+	DeleteInstance(clusterID, instanceID string) error
+	HeartbeatInstance(clusterID, instanceID string) (*discovery.Instance, error)
+
+	// UpdateInstance applies update to the instance and returns the updated
+	// instance. If index is not zero the instance is only updated if its
+	// modification index is index, otherwise ErrConflict is returned.
+	UpdateInstance(clusterID, instanceID string, update *InstanceUpdate, index int64) (*discovery.Instance, error)
+	DeleteExpiredInstances() ([]*discovery.Instance, error)
+
+	// DeleteAbandonedClusters deletes up to limit clusters (or all if limit
+	// is zero) that were created before emptyBefore and have no instances,
+	// or that have not been active since inactiveBefore, together with their
+	// instances and events, and returns them. A zero time disables the
+	// respective condition. If dryRun is true the clusters are only returned.
+	DeleteAbandonedClusters(emptyBefore, inactiveBefore time.Time, limit int, dryRun bool) ([]*discovery.Cluster, error)
+
+	// GetEvents returns the events of the cluster with an ID greater than
+	// afterIndex, ordered by ID.
+	GetEvents(clusterID string, afterIndex int64) ([]*Event, error)
+
+	// SubscribeCluster returns a channel that receives the cluster's new
+	// modification index whenever its membership changes, and a function
+	// that cancels the subscription.
+	SubscribeCluster(clusterID string) (<-chan int64, func())
+}
+
+// HealthChecker is optionally implemented by storage backends that depend on
+// an external service.
+type HealthChecker interface {
+	// CheckHealth returns an error if the backend cannot serve requests or
+	// does not respond within timeout.
+	CheckHealth(timeout time.Duration) error
 }
@@ -0,0 +1,792 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/github.com/jackc/pgx"
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	testStorageBackend(t, NewMemoryBackend())
+}
+
+// TestPostgresBackend runs the conformance suite against the database in
+// TEST_DATABASE_URL. The database must be dedicated to the tests, as
+// testDeleteAbandonedClusters deletes every abandoned cluster in it.
+func TestPostgresBackend(t *testing.T) {
+	db := testPostgresDB(t)
+	defer db.Close()
+	b := NewPostgresBackend(db)
+	defer b.(*PostgresBackend).Close()
+	testStorageBackend(t, b)
+}
+
+// testPostgresDB connects to and migrates the database in TEST_DATABASE_URL,
+// and skips the test if it is not set.
+func testPostgresDB(t *testing.T) *pgx.ConnPool {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	dbConfig, err := pgx.ParseURI(dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: dbConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDB(db, false, ioutil.Discard); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testStorageBackend is the conformance suite that every StorageBackend
+// implementation must pass.
+func testStorageBackend(t *testing.T, b StorageBackend) {
+	for _, test := range []struct {
+		name string
+		fn   func(*testing.T, StorageBackend)
+	}{
+		{"CreateCluster", testCreateCluster},
+		{"CreateInstance", testCreateInstance},
+		{"CreateInstanceExists", testCreateInstanceExists},
+		{"CreateInstanceWithID", testCreateInstanceWithID},
+		{"CreateInstanceUnknownCluster", testCreateInstanceUnknownCluster},
+		{"GetClusterInstances", testGetClusterInstances},
+		{"GetCluster", testGetCluster},
+		{"GetInstance", testGetInstance},
+		{"DeleteInstance", testDeleteInstance},
+		{"UpdateInstance", testUpdateInstance},
+		{"InstanceTTL", testInstanceTTL},
+		{"ModificationIndex", testModificationIndex},
+		{"ClusterSize", testClusterSize},
+		{"Events", testEvents},
+		{"ClusterSecret", testClusterSecret},
+		{"DeleteAbandonedClusters", testDeleteAbandonedClusters},
+		{"CheckHealth", testCheckHealth},
+	} {
+		t.Run(test.name, func(t *testing.T) { test.fn(t, b) })
+	}
+}
+
+func createTestCluster(t *testing.T, b StorageBackend) *discovery.Cluster {
+	cluster := &discovery.Cluster{CreatorIP: "127.0.0.1", CreatorUserAgent: "test"}
+	if err := b.CreateCluster(cluster); err != nil {
+		t.Fatal(err)
+	}
+	return cluster
+}
+
+func isUUID(id string) bool {
+	normalized, ok := normalizeUUID(id)
+	return ok && normalized == strings.ToLower(id)
+}
+
+func testCreateCluster(t *testing.T, b StorageBackend) {
+	start := time.Now().Add(-time.Second)
+	cluster := createTestCluster(t, b)
+	if !isUUID(cluster.ID) {
+		t.Errorf("expected cluster ID to be a UUID, got %q", cluster.ID)
+	}
+	if cluster.CreatedAt.Before(start) {
+		t.Errorf("expected created_at to be set, got %s", cluster.CreatedAt)
+	}
+	if other := createTestCluster(t, b); other.ID == cluster.ID {
+		t.Errorf("expected unique cluster IDs, got %q twice", cluster.ID)
+	}
+}
+
+func testCreateInstance(t *testing.T, b StorageBackend) {
+	start := time.Now().Add(-time.Second)
+	cluster := createTestCluster(t, b)
+	key := testSSHKey(t)
+	inst := &discovery.Instance{
+		ClusterID:     cluster.ID,
+		FlynnVersion:  "v20151104.1",
+		SSHPublicKeys: []discovery.SSHPublicKey{{Type: "ssh-ed25519", Data: key, Fingerprint: sshFingerprint(key)}},
+		URL:           "http://10.0.0.1:1111",
+		Name:          "instance-1",
+		CreatorIP:     "10.0.0.1",
+		PeerURLs:      []string{"http://10.0.0.1:1111", "http://[fd00::1]:1111"},
+	}
+	if err := b.CreateInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	if inst.CreatedIndex == 0 || inst.CreatedIndex != inst.Index {
+		t.Errorf("expected created index to equal index %d, got %d", inst.Index, inst.CreatedIndex)
+	}
+	if !isUUID(inst.ID) {
+		t.Errorf("expected instance ID to be a UUID, got %q", inst.ID)
+	}
+	if inst.CreatedAt == nil || inst.CreatedAt.Before(start) {
+		t.Errorf("expected created_at to be set, got %v", inst.CreatedAt)
+	}
+	stored, err := b.GetInstance(cluster.ID, inst.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.SSHPublicKeys) != 1 || !bytes.Equal(stored.SSHPublicKeys[0].Data, key) || stored.SSHPublicKeys[0].Fingerprint != inst.SSHPublicKeys[0].Fingerprint {
+		t.Errorf("expected SSH public key and fingerprint to be stored, got %+v", stored.SSHPublicKeys)
+	}
+	if !reflect.DeepEqual(stored.PeerURLs, inst.PeerURLs) || stored.CreatedIndex != inst.CreatedIndex {
+		t.Errorf("expected peer URLs %v and created index %d to be stored, got %v and %d", inst.PeerURLs, inst.CreatedIndex, stored.PeerURLs, stored.CreatedIndex)
+	}
+
+	noKeys := &discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.2:1111"}
+	if err := b.CreateInstance(noKeys); err != nil {
+		t.Fatal(err)
+	}
+	if noKeys.SSHPublicKeys == nil {
+		t.Error("expected nil SSH public keys to be stored as an empty list")
+	}
+}
+
+func testCreateInstanceExists(t *testing.T, b StorageBackend) {
+	cluster := createTestCluster(t, b)
+	inst := &discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.1:1111", Name: "first", FlynnVersion: "v1"}
+	if err := b.CreateInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+
+	dup := &discovery.Instance{ClusterID: cluster.ID, URL: inst.URL, Name: "second", FlynnVersion: "v2"}
+	if err := b.CreateInstance(dup); err != ErrExists {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	if dup.ID != inst.ID || dup.Name != "first" || dup.FlynnVersion != "v1" {
+		t.Errorf("expected existing instance to be returned, got %+v", dup)
+	}
+	if dup.CreatedAt == nil || !dup.CreatedAt.Equal(*inst.CreatedAt) {
+		t.Errorf("expected created_at %v, got %v", inst.CreatedAt, dup.CreatedAt)
+	}
+
+	// the same URL may be registered in a different cluster
+	other := &discovery.Instance{ClusterID: createTestCluster(t, b).ID, URL: inst.URL}
+	if err := b.CreateInstance(other); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testCreateInstanceWithID(t *testing.T, b StorageBackend) {
+	cluster := createTestCluster(t, b)
+	id := newUUID()
+	inst := &discovery.Instance{ID: id, ClusterID: cluster.ID, URL: "http://10.0.0.1:1111", Name: "first"}
+	if err := b.CreateInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	if inst.ID != id {
+		t.Errorf("expected instance ID %q, got %q", id, inst.ID)
+	}
+	if got, err := b.GetInstance(cluster.ID, id); err != nil || got.URL != inst.URL {
+		t.Errorf("expected instance to be stored with its ID, got %+v, %v", got, err)
+	}
+
+	dup := &discovery.Instance{ID: id, ClusterID: cluster.ID, URL: "http://10.0.0.2:1111", Name: "second"}
+	if err := b.CreateInstance(dup); err != ErrExists {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	if dup.URL != inst.URL || dup.Name != "first" {
+		t.Errorf("expected existing instance to be returned, got %+v", dup)
+	}
+
+	// instance IDs are unique across clusters
+	other := &discovery.Instance{ID: id, ClusterID: createTestCluster(t, b).ID, URL: inst.URL}
+	if err := b.CreateInstance(other); err != ErrExists {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+}
+
+func testCreateInstanceUnknownCluster(t *testing.T, b StorageBackend) {
+	for _, id := range []string{newUUID(), "not-a-uuid"} {
+		inst := &discovery.Instance{ClusterID: id, URL: "http://10.0.0.1:1111"}
+		if err := b.CreateInstance(inst); err != ErrNotFound {
+			t.Errorf("cluster %q: expected ErrNotFound, got %v", id, err)
+		}
+	}
+}
+
+func testGetClusterInstances(t *testing.T, b StorageBackend) {
+	cluster := createTestCluster(t, b)
+	instances, err := b.GetClusterInstances(cluster.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 0 {
+		t.Fatalf("expected no instances, got %d", len(instances))
+	}
+
+	var created []*discovery.Instance
+	for _, url := range []string{"http://10.0.0.1:1111", "http://10.0.0.2:1111", "http://10.0.0.3:1111"} {
+		inst := &discovery.Instance{ClusterID: cluster.ID, URL: url, Name: url}
+		if err := b.CreateInstance(inst); err != nil {
+			t.Fatal(err)
+		}
+		created = append(created, inst)
+	}
+	// instances in other clusters must not be returned
+	if err := b.CreateInstance(&discovery.Instance{ClusterID: createTestCluster(t, b).ID, URL: "http://10.0.0.4:1111"}); err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err = b.GetClusterInstances(cluster.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != len(created) {
+		t.Fatalf("expected %d instances, got %d", len(created), len(instances))
+	}
+	for i, inst := range instances {
+		if inst.ID != created[i].ID || inst.URL != created[i].URL || inst.ClusterID != cluster.ID {
+			t.Errorf("instance %d: expected %+v, got %+v", i, created[i], inst)
+		}
+	}
+
+	for _, id := range []string{newUUID(), "not-a-uuid"} {
+		instances, err := b.GetClusterInstances(id)
+		if err != nil {
+			t.Errorf("cluster %q: unexpected error %v", id, err)
+		}
+		if len(instances) != 0 {
+			t.Errorf("cluster %q: expected no instances, got %d", id, len(instances))
+		}
+	}
+}
+
+func testGetCluster(t *testing.T, b StorageBackend) {
+	cluster := createTestCluster(t, b)
+	got, err := b.GetCluster(cluster.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != cluster.ID || got.CreatorIP != cluster.CreatorIP || got.CreatorUserAgent != cluster.CreatorUserAgent || !got.CreatedAt.Equal(cluster.CreatedAt) {
+		t.Errorf("expected %+v, got %+v", cluster, got)
+	}
+	if got.InstanceCount != 0 {
+		t.Errorf("expected instance count 0, got %d", got.InstanceCount)
+	}
+
+	for _, url := range []string{"http://10.0.0.1:1111", "http://10.0.0.2:1111"} {
+		if err := b.CreateInstance(&discovery.Instance{ClusterID: cluster.ID, URL: url}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err = b.GetCluster(cluster.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.InstanceCount != 2 {
+		t.Errorf("expected instance count 2, got %d", got.InstanceCount)
+	}
+
+	for _, id := range []string{newUUID(), "not-a-uuid"} {
+		if _, err := b.GetCluster(id); err != ErrNotFound {
+			t.Errorf("cluster %q: expected ErrNotFound, got %v", id, err)
+		}
+	}
+}
+
+func testGetInstance(t *testing.T, b StorageBackend) {
+	cluster := createTestCluster(t, b)
+	inst := &discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.1:1111", Name: "instance-1", CreatorIP: "10.0.0.1"}
+	inst.Secret, inst.SecretHash = newSecret()
+	if err := b.CreateInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	got, err := b.GetInstance(cluster.ID, inst.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != inst.ID || got.ClusterID != cluster.ID || got.URL != inst.URL || got.Name != inst.Name || got.CreatorIP != inst.CreatorIP {
+		t.Errorf("expected %+v, got %+v", inst, got)
+	}
+	if got.SecretHash != inst.SecretHash {
+		t.Errorf("expected secret hash %q, got %q", inst.SecretHash, got.SecretHash)
+	}
+	if got.Secret != "" {
+		t.Errorf("expected the instance secret not to be stored, got %q", got.Secret)
+	}
+
+	for _, ids := range [][2]string{
+		{cluster.ID, newUUID()},
+		{cluster.ID, "not-a-uuid"},
+		{createTestCluster(t, b).ID, inst.ID},
+		{"not-a-uuid", inst.ID},
+	} {
+		if _, err := b.GetInstance(ids[0], ids[1]); err != ErrNotFound {
+			t.Errorf("instance %q in cluster %q: expected ErrNotFound, got %v", ids[1], ids[0], err)
+		}
+	}
+}
+
+func testDeleteInstance(t *testing.T, b StorageBackend) {
+	cluster := createTestCluster(t, b)
+	inst := &discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.1:1111"}
+	if err := b.CreateInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	other := &discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.2:1111"}
+	if err := b.CreateInstance(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.DeleteInstance(createTestCluster(t, b).ID, inst.ID); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound deleting from another cluster, got %v", err)
+	}
+	if err := b.DeleteInstance(cluster.ID, inst.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteInstance(cluster.ID, inst.ID); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound deleting twice, got %v", err)
+	}
+	if _, err := b.GetInstance(cluster.ID, inst.ID); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+
+	instances, err := b.GetClusterInstances(cluster.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].ID != other.ID {
+		t.Errorf("expected only %s to remain, got %+v", other.ID, instances)
+	}
+
+	// the URL can be registered again once deleted
+	if err := b.CreateInstance(&discovery.Instance{ClusterID: cluster.ID, URL: inst.URL}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testUpdateInstance(t *testing.T, b StorageBackend) {
+	cluster := createTestCluster(t, b)
+	inst := &discovery.Instance{ClusterID: cluster.ID, FlynnVersion: "v20151104.1", URL: "http://10.0.0.1:1111", Name: "instance-1"}
+	if err := b.CreateInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	if inst.UpdatedAt == nil || !inst.UpdatedAt.Equal(*inst.CreatedAt) {
+		t.Errorf("expected updated_at to equal created_at, got %v", inst.UpdatedAt)
+	}
+
+	version := "v20151214.0"
+	keys := []discovery.SSHPublicKey{{Type: "ssh-ed25519", Data: testSSHKey(t)}}
+	updated, err := b.UpdateInstance(cluster.ID, inst.ID, &InstanceUpdate{FlynnVersion: &version, SSHPublicKeys: &keys}, inst.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.FlynnVersion != version || len(updated.SSHPublicKeys) != 1 || updated.SSHPublicKeys[0].Type != "ssh-ed25519" {
+		t.Errorf("expected version and keys to be updated, got %+v", updated)
+	}
+	if updated.Name != inst.Name || updated.URL != inst.URL {
+		t.Errorf("expected other fields to be unchanged, got %+v", updated)
+	}
+	if updated.Index <= inst.Index {
+		t.Errorf("expected index to increase from %d, got %d", inst.Index, updated.Index)
+	}
+	if updated.CreatedIndex != inst.Index {
+		t.Errorf("expected created index to stay %d, got %d", inst.Index, updated.CreatedIndex)
+	}
+	if updated.UpdatedAt == nil || updated.UpdatedAt.Before(*inst.UpdatedAt) {
+		t.Errorf("expected updated_at to advance from %v, got %v", inst.UpdatedAt, updated.UpdatedAt)
+	}
+	got, err := b.GetInstance(cluster.ID, inst.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FlynnVersion != version || got.Index != updated.Index {
+		t.Errorf("expected %+v, got %+v", updated, got)
+	}
+	events, err := b.GetEvents(cluster.ID, inst.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != EventInstanceUpdated || events[0].Instance.FlynnVersion != version {
+		t.Errorf("expected an instance_updated event, got %+v", events)
+	}
+
+	// a stale index is rejected
+	name := "instance-2"
+	if _, err := b.UpdateInstance(cluster.ID, inst.ID, &InstanceUpdate{Name: &name}, inst.Index); err != ErrConflict {
+		t.Errorf("expected ErrConflict, got %v", err)
+	}
+	if updated, err := b.UpdateInstance(cluster.ID, inst.ID, &InstanceUpdate{Name: &name}, 0); err != nil {
+		t.Fatal(err)
+	} else if updated.Name != name || updated.FlynnVersion != version {
+		t.Errorf("expected only the name to change, got %+v", updated)
+	}
+
+	for _, ids := range [][2]string{
+		{cluster.ID, newUUID()},
+		{cluster.ID, "not-a-uuid"},
+		{"not-a-uuid", inst.ID},
+	} {
+		if _, err := b.UpdateInstance(ids[0], ids[1], &InstanceUpdate{Name: &name}, 0); err != ErrNotFound {
+			t.Errorf("instance %q in cluster %q: expected ErrNotFound, got %v", ids[1], ids[0], err)
+		}
+	}
+}
+
+func testInstanceTTL(t *testing.T, b StorageBackend) {
+	cluster := createTestCluster(t, b)
+	inst := &discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.1:1111", TTL: 1}
+	if err := b.CreateInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	if inst.ExpiresAt == nil || inst.ExpiresAt.Before(*inst.CreatedAt) {
+		t.Fatalf("expected expires_at to be set, got %v", inst.ExpiresAt)
+	}
+	permanent := &discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.2:1111"}
+	if err := b.CreateInstance(permanent); err != nil {
+		t.Fatal(err)
+	}
+	if permanent.ExpiresAt != nil {
+		t.Errorf("expected no expires_at without a TTL, got %v", permanent.ExpiresAt)
+	}
+
+	beat, err := b.HeartbeatInstance(cluster.ID, inst.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if beat.TTL != 1 || beat.ExpiresAt == nil || beat.ExpiresAt.Before(*inst.ExpiresAt) {
+		t.Errorf("expected heartbeat to extend expires_at past %v, got %v", inst.ExpiresAt, beat.ExpiresAt)
+	}
+	if beat, err := b.HeartbeatInstance(cluster.ID, permanent.ID); err != nil {
+		t.Fatal(err)
+	} else if beat.ExpiresAt != nil {
+		t.Errorf("expected heartbeat without a TTL to leave expires_at unset, got %v", beat.ExpiresAt)
+	}
+
+	time.Sleep(beat.ExpiresAt.Sub(time.Now()) + 100*time.Millisecond)
+
+	instances, err := b.GetClusterInstances(cluster.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].ID != permanent.ID {
+		t.Errorf("expected only %s to be listed, got %+v", permanent.ID, instances)
+	}
+	if _, err := b.GetInstance(cluster.ID, inst.ID); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound getting expired instance, got %v", err)
+	}
+	if _, err := b.HeartbeatInstance(cluster.ID, inst.ID); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound heartbeating expired instance, got %v", err)
+	}
+	if got, err := b.GetCluster(cluster.ID); err != nil {
+		t.Fatal(err)
+	} else if got.InstanceCount != 1 {
+		t.Errorf("expected instance count 1, got %d", got.InstanceCount)
+	}
+
+	expired, err := b.DeleteExpiredInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, e := range expired {
+		if e.ID == permanent.ID {
+			t.Errorf("expected %s not to be reaped", permanent.ID)
+		}
+		if e.ID == inst.ID && e.ClusterID == cluster.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected %s to be reaped, got %+v", inst.ID, expired)
+	}
+
+	// the URL of an expired instance can be registered again
+	if err := b.CreateInstance(&discovery.Instance{ClusterID: cluster.ID, URL: inst.URL}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testModificationIndex(t *testing.T, b StorageBackend) {
+	cluster := createTestCluster(t, b)
+	assertIndex := func(expected int64) {
+		got, err := b.GetCluster(cluster.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Index != expected {
+			t.Errorf("expected cluster index %d, got %d", expected, got.Index)
+		}
+	}
+	assertIndex(0)
+
+	updates, stop := b.SubscribeCluster(cluster.ID)
+	defer stop()
+	assertUpdate := func(expected int64) {
+		select {
+		case index := <-updates:
+			if index != expected {
+				t.Errorf("expected notification of index %d, got %d", expected, index)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("timed out waiting for notification of index %d", expected)
+		}
+	}
+
+	inst := &discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.1:1111", TTL: 60}
+	if err := b.CreateInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	if inst.Index != 1 {
+		t.Errorf("expected instance index 1, got %d", inst.Index)
+	}
+	assertUpdate(1)
+	assertIndex(1)
+
+	// conflicts and heartbeats don't change membership
+	if err := b.CreateInstance(&discovery.Instance{ClusterID: cluster.ID, URL: inst.URL}); err != ErrExists {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	if _, err := b.HeartbeatInstance(cluster.ID, inst.ID); err != nil {
+		t.Fatal(err)
+	}
+	assertIndex(1)
+
+	// other clusters don't notify
+	if err := b.CreateInstance(&discovery.Instance{ClusterID: createTestCluster(t, b).ID, URL: inst.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.DeleteInstance(cluster.ID, inst.ID); err != nil {
+		t.Fatal(err)
+	}
+	assertUpdate(2)
+	assertIndex(2)
+}
+
+func testClusterSize(t *testing.T, b StorageBackend) {
+	cluster := &discovery.Cluster{CreatorIP: "127.0.0.1", CreatorUserAgent: "test", Size: 2}
+	if err := b.CreateCluster(cluster); err != nil {
+		t.Fatal(err)
+	}
+	assertCluster := func(count int, complete bool) {
+		got, err := b.GetCluster(cluster.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Size != 2 || got.InstanceCount != count || got.Complete != complete {
+			t.Errorf("expected size 2, instance count %d and complete %v, got %+v", count, complete, got)
+		}
+	}
+	assertCluster(0, false)
+
+	first := &discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.1:1111"}
+	for _, inst := range []*discovery.Instance{first, {ClusterID: cluster.ID, URL: "http://10.0.0.2:1111"}} {
+		if err := b.CreateInstance(inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCluster(2, true)
+
+	if err := b.CreateInstance(&discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.3:1111"}); err != ErrClusterFull {
+		t.Errorf("expected ErrClusterFull, got %v", err)
+	}
+	// existing instances can still register again
+	if err := b.CreateInstance(&discovery.Instance{ClusterID: cluster.ID, URL: first.URL}); err != ErrExists {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+
+	if err := b.DeleteInstance(cluster.ID, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	assertCluster(1, false)
+	if err := b.CreateInstance(&discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.3:1111"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if unsized := createTestCluster(t, b); unsized.Size != 0 {
+		t.Errorf("expected size 0, got %d", unsized.Size)
+	}
+}
+
+func testEvents(t *testing.T, b StorageBackend) {
+	cluster := createTestCluster(t, b)
+	created := &discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.1:1111", Name: "instance-1"}
+	if err := b.CreateInstance(created); err != nil {
+		t.Fatal(err)
+	}
+	expiring := &discovery.Instance{ClusterID: cluster.ID, URL: "http://10.0.0.2:1111", TTL: 1}
+	if err := b.CreateInstance(expiring); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteInstance(cluster.ID, created.ID); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(expiring.ExpiresAt.Sub(time.Now()) + 100*time.Millisecond)
+	if _, err := b.DeleteExpiredInstances(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := b.GetEvents(cluster.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		typ  EventType
+		inst *discovery.Instance
+	}{
+		{EventInstanceCreated, created},
+		{EventInstanceCreated, expiring},
+		{EventInstanceDeleted, created},
+		{EventInstanceExpired, expiring},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+	for i, e := range expected {
+		event := events[i]
+		if event.ID != int64(i+1) || event.Type != e.typ || event.ClusterID != cluster.ID {
+			t.Errorf("event %d: expected %s with ID %d, got %+v", i, e.typ, i+1, event)
+		}
+		if event.Instance == nil || event.Instance.ID != e.inst.ID || event.Instance.URL != e.inst.URL || event.Instance.Name != e.inst.Name || event.Instance.CreatedIndex != e.inst.CreatedIndex {
+			t.Errorf("event %d: expected instance %+v, got %+v", i, e.inst, event.Instance)
+		}
+	}
+
+	events, err = b.GetEvents(cluster.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].ID != 3 {
+		t.Errorf("expected events after 2 to start at 3, got %+v", events)
+	}
+	for _, id := range []string{newUUID(), "not-a-uuid"} {
+		if events, err := b.GetEvents(id, 0); err != nil || len(events) != 0 {
+			t.Errorf("cluster %q: expected no events, got %v, %v", id, events, err)
+		}
+	}
+}
+
+func testClusterSecret(t *testing.T, b StorageBackend) {
+	cluster := &discovery.Cluster{CreatorIP: "127.0.0.1", CreatorUserAgent: "test", SecretHash: "hash1", Private: true}
+	if err := b.CreateCluster(cluster); err != nil {
+		t.Fatal(err)
+	}
+	assertHash := func(expected string) {
+		got, err := b.GetCluster(cluster.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.SecretHash != expected || !got.Private || got.Secret != "" {
+			t.Errorf("expected secret hash %q on a private cluster, got %+v", expected, got)
+		}
+	}
+	assertHash("hash1")
+
+	if err := b.SetClusterSecret(cluster.ID, "wrong", "hash2"); err != ErrConflict {
+		t.Errorf("expected ErrConflict, got %v", err)
+	}
+	assertHash("hash1")
+	if err := b.SetClusterSecret(cluster.ID, "hash1", "hash2"); err != nil {
+		t.Fatal(err)
+	}
+	assertHash("hash2")
+
+	// clusters without a secret get their first one by passing an empty hash
+	legacy := createTestCluster(t, b)
+	if err := b.SetClusterSecret(legacy.ID, "", "hash3"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := b.GetCluster(legacy.ID); err != nil {
+		t.Fatal(err)
+	} else if got.SecretHash != "hash3" {
+		t.Errorf("expected secret hash %q, got %q", "hash3", got.SecretHash)
+	}
+
+	for _, id := range []string{newUUID(), "not-a-uuid"} {
+		if err := b.SetClusterSecret(id, "", "hash"); err != ErrNotFound {
+			t.Errorf("cluster %q: expected ErrNotFound, got %v", id, err)
+		}
+	}
+}
+
+// testDeleteAbandonedClusters only asserts on the clusters it creates, as
+// other tests leave clusters behind. The backend's abandoned clusters are
+// all deleted, so the suite must not run against a database in use.
+func testDeleteAbandonedClusters(t *testing.T, b StorageBackend) {
+	empty := createTestCluster(t, b)
+	active := createTestCluster(t, b)
+	inst := &discovery.Instance{ClusterID: active.ID, URL: "http://10.0.0.1:1111"}
+	if err := b.CreateInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	active, err := b.GetCluster(active.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active.ActiveAt.Before(*inst.CreatedAt) {
+		t.Errorf("expected cluster to be active at %v, got %v", inst.CreatedAt, active.ActiveAt)
+	}
+	later := time.Now().Add(time.Second)
+
+	contains := func(clusters []*discovery.Cluster, id string) bool {
+		for _, c := range clusters {
+			if c.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	clusters, err := b.DeleteAbandonedClusters(later, time.Time{}, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(clusters, empty.ID) || contains(clusters, active.ID) {
+		t.Errorf("expected only the empty cluster to be abandoned, got %+v", clusters)
+	}
+	clusters, err = b.DeleteAbandonedClusters(time.Time{}, active.ActiveAt, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contains(clusters, active.ID) {
+		t.Error("expected the cluster not to be inactive")
+	}
+	if clusters, err := b.DeleteAbandonedClusters(later, later, 1, true); err != nil {
+		t.Fatal(err)
+	} else if len(clusters) != 1 {
+		t.Errorf("expected the limit to be respected, got %d clusters", len(clusters))
+	}
+	if _, err := b.GetCluster(empty.ID); err != nil {
+		t.Errorf("expected a dry run not to delete clusters, got %v", err)
+	}
+
+	clusters, err = b.DeleteAbandonedClusters(later, later, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(clusters, empty.ID) || !contains(clusters, active.ID) {
+		t.Errorf("expected both clusters to be deleted, got %+v", clusters)
+	}
+	for _, id := range []string{empty.ID, active.ID} {
+		if _, err := b.GetCluster(id); err != ErrNotFound {
+			t.Errorf("cluster %s: expected ErrNotFound, got %v", id, err)
+		}
+	}
+	if instances, err := b.GetClusterInstances(active.ID); err != nil || len(instances) != 0 {
+		t.Errorf("expected instances to be deleted, got %v, %v", instances, err)
+	}
+	if events, err := b.GetEvents(active.ID, 0); err != nil || len(events) != 0 {
+		t.Errorf("expected events to be deleted, got %v, %v", events, err)
+	}
+}
+
+func testCheckHealth(t *testing.T, b StorageBackend) {
+	hc, ok := b.(HealthChecker)
+	if !ok {
+		t.Skip("backend does not implement HealthChecker")
+	}
+	if err := hc.CheckHealth(5 * time.Second); err != nil {
+		t.Errorf("expected backend to be healthy, got %s", err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/flynn/flynn-discovery/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+	"github.com/flynn/flynn-discovery/discovery"
+)
+
+// validationError describes why a field of a request payload is invalid. The
+// message is written to follow the field name, e.g. "url is required".
+type validationError struct {
+	Field   string
+	Message string
+}
+
+func (e *validationError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+const minRSAKeyBits = 2048
+
+// instanceSchemaJSON is the JSON Schema of instance registrations. SSH key
+// data is at most 8192 bytes, which is 10924 characters of base64. DSA keys
+// are limited to 1024 bits, so they are not accepted.
+const instanceSchemaJSON = `{
+	"type": "object",
+	"required": ["url"],
+	"properties": {
+		"url": {
+			"type": "string",
+			"maxLength": 2048,
+			"format": "http-url"
+		},
+		"peer_urls": {
+			"type": ["array", "null"],
+			"maxItems": 10,
+			"items": {
+				"type": "string",
+				"maxLength": 2048,
+				"format": "http-url"
+			}
+		},
+		"name": {
+			"type": "string",
+			"maxLength": 253,
+			"pattern": "^([a-zA-Z0-9][a-zA-Z0-9._-]*)?$",
+			"errorMessage": "must start with a letter or digit and only contain letters, digits, '.', '_' and '-'"
+		},
+		"flynn_version": {
+			"type": "string",
+			"pattern": "^(|dev|v[0-9]{8}\\.[0-9]+(-[a-zA-Z0-9.-]+)?)$",
+			"errorMessage": "must be a Flynn release version like \"v20151104.1\" or \"dev\""
+		},
+		"ssh_public_keys": {
+			"type": ["array", "null"],
+			"maxItems": 10,
+			"items": {
+				"type": "object",
+				"required": ["type", "data"],
+				"format": "ssh-public-key",
+				"properties": {
+					"type": {
+						"type": "string",
+						"enum": ["ssh-rsa", "ssh-ed25519", "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521"],
+						"errorMessage": "is not a supported SSH public key type"
+					},
+					"data": {
+						"type": "string",
+						"minLength": 1,
+						"maxLength": 10924
+					}
+				}
+			}
+		},
+		"ttl": {
+			"type": "integer",
+			"minimum": 0
+		}
+	}
+}`
+
+// schemaFormats are the values of the format keyword used by the schemas.
+var schemaFormats = map[string]jsonSchemaFormat{
+	"http-url":       validateHTTPURL,
+	"ssh-public-key": validateSSHPublicKey,
+}
+
+var instanceSchema = mustParseJSONSchema(instanceSchemaJSON, schemaFormats)
+
+// mutableInstanceFields are the fields of an instance that can be updated,
+// the JSON names of the fields of InstanceUpdate.
+var mutableInstanceFields = map[string]bool{
+	"flynn_version":   true,
+	"name":            true,
+	"ssh_public_keys": true,
+}
+
+// validateInstanceJSON checks an instance registration document against
+// instanceSchema and returns the first violation, or nil if it is valid. If
+// partial is true the document is an update that only contains the changed
+// fields, which must be mutable.
+func validateInstanceJSON(data json.RawMessage, partial bool) *validationError {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return &validationError{"data", "must be valid JSON"}
+	}
+	if v == nil {
+		return &validationError{"data", "is required"}
+	}
+	if fields, ok := v.(map[string]interface{}); ok && partial {
+		// updates may only change the fields of InstanceUpdate
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !mutableInstanceFields[name] {
+				return &validationError{name, "cannot be changed"}
+			}
+		}
+	}
+	if err := instanceSchema.validate("", v, schemaFormats, partial); err != nil {
+		if err.Field == "" {
+			err.Field = "data"
+		}
+		return err
+	}
+	return nil
+}
+
+// validateInstance checks inst against instanceSchema.
+func validateInstance(inst *discovery.Instance) *validationError {
+	data, err := json.Marshal(inst)
+	if err != nil {
+		return &validationError{"data", "must be valid JSON"}
+	}
+	return validateInstanceJSON(data, false)
+}
+
+func validateHTTPURL(field string, v interface{}) *validationError {
+	s, _ := v.(string)
+	if s == "" {
+		return &validationError{field, "is required"}
+	}
+	u, err := url.Parse(s)
+	if err != nil || !u.IsAbs() {
+		return &validationError{field, "must be an absolute URL"}
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return &validationError{field, "must have an http or https scheme"}
+	}
+	if u.Host == "" {
+		return &validationError{field, "must have a host"}
+	}
+	if u.User != nil {
+		return &validationError{field, "must not contain credentials"}
+	}
+	return nil
+}
+
+// validateSSHPublicKey checks that the data of an SSH public key object is a
+// key of its type, and that RSA keys are long enough.
+func validateSSHPublicKey(field string, v interface{}) *validationError {
+	key, _ := v.(map[string]interface{})
+	typ, _ := key["type"].(string)
+	s, _ := key["data"].(string)
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return &validationError{field + ".data", "must be base64 encoded"}
+	}
+	pub, err := ssh.ParsePublicKey(data)
+	if err != nil {
+		return &validationError{field + ".data", "is not a valid SSH public key"}
+	}
+	if pub.Type() != typ {
+		return &validationError{field + ".type", fmt.Sprintf("does not match the %s key in data", pub.Type())}
+	}
+	if rsaKey, ok := cryptoPublicKey(pub).(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minRSAKeyBits {
+		return &validationError{field + ".data", fmt.Sprintf("must be an RSA key of at least %d bits", minRSAKeyBits)}
+	}
+	return nil
+}
+
+func cryptoPublicKey(pub ssh.PublicKey) crypto.PublicKey {
+	if k, ok := pub.(ssh.CryptoPublicKey); ok {
+		return k.CryptoPublicKey()
+	}
+	return nil
+}
+
+// setSSHFingerprints sets the fingerprint of each key from its data, ignoring
+// any fingerprint sent by the client.
+func setSSHFingerprints(keys []discovery.SSHPublicKey) {
+	for i := range keys {
+		keys[i].Fingerprint = sshFingerprint(keys[i].Data)
+	}
+}
+
+// sshFingerprint returns the SHA256 fingerprint of the SSH public key data in
+// the format of ssh-keygen -l.
+func sshFingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}